@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/plexporter/pkg/config"
+)
+
+// loadConfig builds the configuration from, in increasing order of
+// precedence, the defaults, the config file, environment variables and
+// command line flags.
+func loadConfig(args []string) (*config.Config, error) {
+	fs := flag.NewFlagSet("prometheus-plex-exporter", flag.ContinueOnError)
+	var (
+		configFile      = fs.String("config.file", os.Getenv("CONFIG_FILE"), "Path to a YAML config file. (env: CONFIG_FILE)")
+		listenAddress   = fs.String("web.listen-address", os.Getenv("LISTEN_ADDRESS"), "Address to serve metrics on. (env: LISTEN_ADDRESS)")
+		servers         = fs.String("plex.server", os.Getenv("PLEX_SERVER"), "Comma separated Plex server URLs, replacing any servers in the config file. (env: PLEX_SERVER)")
+		tokens          = fs.String("plex.token", os.Getenv("PLEX_TOKEN"), "A Plex token for all servers, or comma separated tokens per server. (env: PLEX_TOKEN)")
+		tokenFiles      = fs.String("plex.token-file", os.Getenv("PLEX_TOKEN_FILE"), "A file holding the Plex token for all servers, or comma separated files per server. (env: PLEX_TOKEN_FILE)")
+		refreshInterval = fs.String("refresh-interval", os.Getenv("REFRESH_INTERVAL"), "How often to poll each server. (env: REFRESH_INTERVAL)")
+		sessionTimeout  = fs.String("session-timeout", os.Getenv("SESSION_TIMEOUT"), "How long stopped sessions are reported. (env: SESSION_TIMEOUT)")
+		stateFile       = fs.String("state.file", os.Getenv("STATE_FILE"), "Path to save cumulative counters to across restarts. (env: STATE_FILE)")
+		playMetrics     = fs.String("play-metrics.mode", os.Getenv("PLAY_METRICS_MODE"), "How play metrics are reported: session, aggregated or both. (env: PLAY_METRICS_MODE)")
+		aggregateLabels = fs.String("play-metrics.aggregate-labels", os.Getenv("PLAY_METRICS_AGGREGATE_LABELS"), "Comma separated labels kept by aggregated play metrics. (env: PLAY_METRICS_AGGREGATE_LABELS)")
+		playLabels      = fs.String("play-metrics.labels", os.Getenv("PLAY_METRICS_LABELS"), "Comma separated labels reported on per-session play metrics. (env: PLAY_METRICS_LABELS)")
+		dropLabels      = fs.String("play-metrics.drop-labels", os.Getenv("PLAY_METRICS_DROP_LABELS"), "Comma separated labels removed from per-session play metrics. (env: PLAY_METRICS_DROP_LABELS)")
+		completed       = fs.String("play-metrics.completed-threshold", os.Getenv("PLAY_METRICS_COMPLETED_THRESHOLD"), "Percentage of the media a play must reach to count as completed. (env: PLAY_METRICS_COMPLETED_THRESHOLD)")
+		privacyMode     = fs.String("privacy.mode", os.Getenv("PRIVACY_MODE"), "Set to hash to replace user, device and title labels with salted hashes. (env: PRIVACY_MODE)")
+		privacySalt     = fs.String("privacy.salt", os.Getenv("PRIVACY_SALT"), "Secret salt for hashed labels. (env: PRIVACY_SALT)")
+		libraryInclude  = fs.String("libraries.include", os.Getenv("LIBRARIES_INCLUDE"), "Comma separated names of the only libraries to report. (env: LIBRARIES_INCLUDE)")
+		libraryExclude  = fs.String("libraries.exclude", os.Getenv("LIBRARIES_EXCLUDE"), "Comma separated names of libraries not to report. (env: LIBRARIES_EXCLUDE)")
+		webhookEnabled  = fs.Bool("webhook.enabled", os.Getenv("WEBHOOK_ENABLED") == "true", "Receive Plex webhooks on /webhook. (env: WEBHOOK_ENABLED)")
+		webhookSecret   = fs.String("webhook.secret", os.Getenv("WEBHOOK_SECRET"), "Secret webhook requests must pass as ?secret=. (env: WEBHOOK_SECRET)")
+		recordFile      = fs.String("record.file", os.Getenv("RECORD_FILE"), "Path to record server responses and notifications to. (env: RECORD_FILE)")
+		replayFile      = fs.String("replay.file", os.Getenv("REPLAY_FILE"), "Path to a recording to replay instead of connecting to servers. (env: REPLAY_FILE)")
+		replaySpeed     = fs.String("replay.speed", os.Getenv("REPLAY_SPEED"), "How many times faster than real time to replay a recording. (env: REPLAY_SPEED)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *listenAddress != "" {
+		cfg.ListenAddress = *listenAddress
+	}
+
+	if *stateFile != "" {
+		cfg.StateFile = *stateFile
+	}
+	if *playMetrics != "" {
+		cfg.PlayMetrics.Mode = *playMetrics
+	}
+	if labels := splitList(*aggregateLabels); len(labels) > 0 {
+		cfg.PlayMetrics.AggregateLabels = labels
+	}
+	if labels := splitList(*playLabels); len(labels) > 0 {
+		cfg.PlayMetrics.Labels = labels
+	}
+	if labels := splitList(*dropLabels); len(labels) > 0 {
+		cfg.PlayMetrics.DropLabels = labels
+	}
+	if *completed != "" {
+		threshold, err := strconv.ParseFloat(*completed, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid completed threshold %q: %w", *completed, err)
+		}
+		cfg.PlayMetrics.CompletedThreshold = threshold
+	}
+	if *privacyMode != "" {
+		cfg.Privacy.Mode = *privacyMode
+	}
+	if *privacySalt != "" {
+		cfg.Privacy.Salt = *privacySalt
+	}
+	if names := splitList(*libraryInclude); len(names) > 0 {
+		cfg.Libraries.Include = names
+	}
+	if names := splitList(*libraryExclude); len(names) > 0 {
+		cfg.Libraries.Exclude = names
+	}
+	if *webhookEnabled {
+		cfg.Webhook.Enabled = true
+	}
+	if *webhookSecret != "" {
+		cfg.Webhook.Secret = *webhookSecret
+	}
+
+	if *recordFile != "" {
+		cfg.RecordFile = *recordFile
+	}
+	if *replayFile != "" {
+		cfg.Replay.File = *replayFile
+	}
+	if *replaySpeed != "" {
+		speed, err := strconv.ParseFloat(*replaySpeed, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replay speed %q: %w", *replaySpeed, err)
+		}
+		cfg.Replay.Speed = speed
+	}
+
+	if err := parseDuration(*refreshInterval, "refresh interval", &cfg.RefreshInterval); err != nil {
+		return nil, err
+	}
+	if err := parseDuration(*sessionTimeout, "session timeout", &cfg.SessionTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := applyServers(cfg, splitList(*servers), splitList(*tokens), splitList(*tokenFiles)); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func parseDuration(value, name string, d *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// applyServers overrides the configured servers. When addresses are given
+// they replace the servers from the config file. Tokens and token files hold
+// either a single value shared by all servers or one value per server in the
+// same order, and replace whichever of the two a server had.
+func applyServers(cfg *config.Config, addresses, tokens, tokenFiles []string) error {
+	if len(addresses) > 0 {
+		cfg.Servers = make([]config.Server, 0, len(addresses))
+		for _, address := range addresses {
+			cfg.Servers = append(cfg.Servers, config.Server{URL: address})
+		}
+	}
+
+	if len(tokens) > 0 && len(tokenFiles) > 0 {
+		return errors.New("PLEX_TOKEN and PLEX_TOKEN_FILE cannot both be set")
+	}
+
+	if err := applyPerServer(cfg, "PLEX_TOKEN", tokens, func(server *config.Server, token string) {
+		server.Token = token
+		server.TokenFile = ""
+	}); err != nil {
+		return err
+	}
+	return applyPerServer(cfg, "PLEX_TOKEN_FILE", tokenFiles, func(server *config.Server, path string) {
+		server.Token = ""
+		server.TokenFile = path
+	})
+}
+
+func applyPerServer(cfg *config.Config, name string, values []string, apply func(*config.Server, string)) error {
+	if len(values) == 0 {
+		return nil
+	}
+	if len(values) != 1 && len(values) != len(cfg.Servers) {
+		return fmt.Errorf("%s must contain a single value or one value per server", name)
+	}
+
+	for i := range cfg.Servers {
+		if len(values) == 1 {
+			apply(&cfg.Servers[i], values[0])
+		} else {
+			apply(&cfg.Servers[i], values[i])
+		}
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
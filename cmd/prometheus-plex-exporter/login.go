@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/grafana/plexporter/pkg/config"
+	"github.com/grafana/plexporter/pkg/plex"
+)
+
+// How often plex.tv is asked whether the user has signed in.
+const loginPollInterval = 2 * time.Second
+
+// runLogin signs in to plex.tv, saves the token to the configured token
+// file and lists the servers the account can monitor.
+func runLogin(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("prometheus-plex-exporter login", flag.ContinueOnError)
+	var (
+		configFile = fs.String("config.file", os.Getenv("CONFIG_FILE"), "Path to a YAML config file, to save the token to its token_file. (env: CONFIG_FILE)")
+		tokenFile  = fs.String("plex.token-file", os.Getenv("PLEX_TOKEN_FILE"), "File to save the token to. (env: PLEX_TOKEN_FILE)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path, err := loginTokenFile(*configFile, *tokenFile)
+	if err != nil {
+		return err
+	}
+
+	tv, err := plex.NewPlexTV()
+	if err != nil {
+		return err
+	}
+	pin, err := tv.RequestPIN(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Open this link and sign in to Plex to let the exporter use your account:\n\n    %s\n\nWaiting for you to sign in...\n", tv.LoginURL(pin))
+
+	token, err := tv.WaitForToken(ctx, pin, loginPollInterval)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return fmt.Errorf("cannot save token: %w", err)
+	}
+	fmt.Printf("Signed in, the token is saved in %s.\n", path)
+
+	servers, err := tv.Servers(ctx, token)
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		fmt.Println("\nThe account has no servers.")
+		return nil
+	}
+
+	fmt.Println("\nSet PLEX_SERVER to the address of the server to monitor, one the exporter can reach:")
+	for _, server := range servers {
+		owner := ""
+		if !server.Owned {
+			owner = " (shared with you, only its owner's token can read every metric)"
+		}
+		fmt.Printf("\n  %s%s\n", server.Name, owner)
+		for _, conn := range server.Connections {
+			network := "remote"
+			if conn.Local {
+				network = "local"
+			}
+			fmt.Printf("    %s (%s)\n", conn.URI, network)
+		}
+	}
+
+	return nil
+}
+
+// loginTokenFile returns where the token is saved: the token file passed to
+// login, or the one servers in the config file read their token from.
+func loginTokenFile(configFile, tokenFile string) (string, error) {
+	if files := splitList(tokenFile); len(files) > 0 {
+		if len(files) > 1 {
+			return "", errors.New("login saves a single token, pass a single token file")
+		}
+		return files[0], nil
+	}
+
+	if configFile == "" {
+		return "", errors.New("no token file to save the token to, set -plex.token-file or PLEX_TOKEN_FILE")
+	}
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return "", err
+	}
+
+	var path string
+	for _, server := range cfg.Servers {
+		if server.TokenFile == "" || server.TokenFile == path {
+			continue
+		}
+		if path != "" {
+			return "", fmt.Errorf("servers in %s use several token files, pass the one to save to with -plex.token-file", configFile)
+		}
+		path = server.TokenFile
+	}
+	if path == "" {
+		return "", fmt.Errorf("no server in %s has a token_file, set -plex.token-file or PLEX_TOKEN_FILE", configFile)
+	}
+	return path, nil
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,46 +17,105 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/grafana/plexporter/pkg/config"
 	"github.com/grafana/plexporter/pkg/metrics"
 	"github.com/grafana/plexporter/pkg/plex"
+	"github.com/grafana/plexporter/pkg/redact"
 )
 
 const (
-	MetricsServerAddr = ":9000"
+	// How long to wait before retrying a server that couldn't be reached
+	// at startup.
+	serverRetryInterval = 30 * time.Second
+
+	// How often token files are checked for a new token.
+	tokenFileInterval = 10 * time.Second
 )
 
 var (
-	log = kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+	log = redact.Logger(kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr)))
 )
 
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	serverAddress := os.Getenv("PLEX_SERVER")
-	if serverAddress == "" {
-		level.Error(log).Log("msg", "PLEX_SERVER environment variable must be specified")
-		os.Exit(1)
+	if len(os.Args) > 1 && os.Args[1] == "login" {
+		err := runLogin(ctx, os.Args[2:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if err != nil {
+			level.Error(log).Log("msg", "cannot log in to plex.tv", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	plexToken := os.Getenv("PLEX_TOKEN")
-	if plexToken == "" {
-		level.Error(log).Log("msg", "PLEX_TOKEN environment variable must be specified")
-		os.Exit(1)
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-
-	server, err := plex.NewServer(serverAddress, plexToken)
 	if err != nil {
-		level.Error(log).Log("msg", "cannot initialize connection to plex server", "error", err)
+		level.Error(log).Log("msg", "cannot load configuration", "error", err)
 		os.Exit(1)
 	}
 
-	metrics.Register(server)
+	var replay *plex.Replay
+	if cfg.Replay.File != "" {
+		replay, err = startReplay(cfg)
+		if err != nil {
+			level.Error(log).Log("msg", "cannot replay recording", "path", cfg.Replay.File, "error", err)
+			os.Exit(1)
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-replay.Done():
+				level.Info(log).Log("msg", "reached the end of the recording", "path", cfg.Replay.File)
+			}
+		}()
+	}
+
+	var recorder *plex.Recorder
+	if cfg.RecordFile != "" {
+		recorder, err = plex.NewRecorder(cfg.RecordFile)
+		if err != nil {
+			level.Error(log).Log("msg", "cannot open record file", "path", cfg.RecordFile, "error", err)
+			os.Exit(1)
+		}
+		level.Info(log).Log("msg", "recording server traffic", "path", cfg.RecordFile)
+	}
+
+	servers := &plex.Servers{}
+	metrics.Register(servers)
+
+	if replay != nil {
+		// Recorded webhooks are fed straight to the servers, whether or
+		// not the webhook endpoint is enabled.
+		go replay.SendWebhooks(ctx, plex.NewWebhookHandler(servers, "", log))
+	}
+
+	var stateFile *plex.StateFile
+	if cfg.StateFile != "" {
+		stateFile, err = plex.LoadStateFile(cfg.StateFile, servers)
+		if err != nil {
+			level.Error(log).Log("msg", "cannot load state file", "path", cfg.StateFile, "error", err)
+			os.Exit(1)
+		}
+		go stateFile.Run(ctx, cfg.StateInterval, log)
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	if cfg.Webhook.Enabled {
+		if cfg.Webhook.Secret == "" {
+			level.Warn(log).Log("msg", "webhook endpoint is enabled without a secret")
+		}
+		mux.Handle("/webhook", plex.NewWebhookHandler(servers, cfg.Webhook.Secret, log))
+	}
 	metricsServer := http.Server{
-		Addr:         MetricsServerAddr,
+		Addr:         cfg.ListenAddress,
 		Handler:      mux,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
@@ -60,18 +123,46 @@ func main() {
 	}
 
 	go func() {
-		level.Info(log).Log("msg", "starting metrics server on "+MetricsServerAddr)
-		err = metricsServer.ListenAndServe()
+		level.Info(log).Log("msg", "starting metrics server on "+cfg.ListenAddress)
+		err := metricsServer.ListenAndServe()
 		if !errors.Is(err, http.ErrServerClosed) {
 			level.Error(log).Log("msg", "cannot start metrics server", "error", err)
 		}
 	}()
 
-	exitCode := 0
-	err = server.Listen(ctx, log)
-	if err != nil {
-		level.Error(log).Log("msg", "cannot listen to plex server events", "error", err)
-		exitCode = 1
+	var (
+		wg       sync.WaitGroup
+		exitMtx  sync.Mutex
+		exitCode = 0
+	)
+	for _, serverCfg := range cfg.Servers {
+		wg.Add(1)
+		go func(serverCfg config.Server) {
+			defer wg.Done()
+			if err := runServer(ctx, servers, stateFile, recorder, serverCfg, cfg); err != nil {
+				level.Error(log).Log("msg", "cannot listen to plex server events", "server", serverCfg.URL, "error", err)
+				exitMtx.Lock()
+				exitCode = 1
+				exitMtx.Unlock()
+			}
+		}(serverCfg)
+	}
+	wg.Wait()
+
+	if stateFile != nil {
+		if err := stateFile.Save(); err != nil {
+			level.Error(log).Log("msg", "cannot save state file", "path", cfg.StateFile, "error", err)
+		}
+	}
+
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			level.Error(log).Log("msg", "cannot close record file", "path", cfg.RecordFile, "error", err)
+		}
+	}
+
+	if replay != nil {
+		replay.Close()
 	}
 
 	level.Debug(log).Log("msg", "shutting down metrics server")
@@ -83,3 +174,122 @@ func main() {
 
 	os.Exit(exitCode)
 }
+
+func serverOptions(serverCfg config.Server, cfg *config.Config, recorder *plex.Recorder) []plex.ServerOption {
+	opts := []plex.ServerOption{
+		plex.WithName(serverCfg.Name),
+		plex.WithRefreshInterval(serverCfg.RefreshInterval),
+		plex.WithSessionTimeout(cfg.SessionTimeout),
+		plex.WithWebsocket(serverCfg.Events != config.EventsWebhook),
+		plex.WithPlayMetrics(cfg.PlayMetrics.Mode, cfg.PlayMetrics.AggregateLabels),
+		plex.WithPlayLabels(cfg.PlayMetrics.SessionLabels()),
+		plex.WithCompletedThreshold(cfg.PlayMetrics.CompletedThreshold),
+		plex.WithLibraryFilter(serverCfg.Libraries.Include, serverCfg.Libraries.Exclude),
+		plex.WithAnonymizer(plex.NewAnonymizer(cfg.Privacy.Mode, cfg.Privacy.Salt, cfg.Privacy.Labels, cfg.Privacy.Aliases)),
+		plex.WithRecorder(recorder),
+	}
+	for name, source := range cfg.Sources {
+		opts = append(opts, plex.WithRefreshSchedule(name, source.Interval, source.Timeout))
+	}
+	return opts
+}
+
+// runServer connects to a single server and listens to it until ctx is
+// cancelled. Servers that can't be reached at startup are retried, so one
+// unavailable server doesn't hold up the others.
+func runServer(ctx context.Context, servers *plex.Servers, stateFile *plex.StateFile, recorder *plex.Recorder, serverCfg config.Server, cfg *config.Config) error {
+	opts := serverOptions(serverCfg, cfg, recorder)
+
+	// Until the server answers its name and ID are unknown, so it's
+	// reported down under its configured name, or its URL.
+	name := serverCfg.Name
+	if name == "" {
+		name = serverCfg.URL
+	}
+
+	var (
+		tokenFile *plex.TokenFile
+		server    *plex.Server
+	)
+	for {
+		var err error
+		if serverCfg.TokenFile != "" && tokenFile == nil {
+			// The token file may not be written yet, for example until
+			// someone signs in, so it's retried along with the server.
+			tokenFile, err = plex.NewTokenFile(serverCfg.TokenFile)
+			if err == nil {
+				go tokenFile.Watch(ctx, tokenFileInterval, log)
+				opts = append(opts, plex.WithTokenSource(tokenFile))
+			} else {
+				err = fmt.Errorf("cannot read token file %s: %w", serverCfg.TokenFile, err)
+			}
+		}
+		if err == nil {
+			server, err = plex.NewServer(serverCfg.URL, serverCfg.Token, opts...)
+		}
+		if err == nil {
+			metrics.ServerUp.DeleteLabelValues("plex", name, "")
+			break
+		}
+
+		metrics.ServerUp.WithLabelValues("plex", name, "").Set(0)
+		level.Error(log).Log("msg", "cannot initialize connection to plex server", "server", serverCfg.URL, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(serverRetryInterval):
+		}
+	}
+
+	if stateFile != nil {
+		stateFile.Restore(server)
+	}
+	servers.Add(server)
+
+	return server.Run(ctx, log)
+}
+
+// startReplay serves a recording and points the exporter at it in place of
+// the configured servers. Servers keep their configured names when the
+// recording has their URL.
+func startReplay(cfg *config.Config) (*plex.Replay, error) {
+	entries, err := plex.LoadCapture(cfg.Replay.File)
+	if err != nil {
+		return nil, err
+	}
+	replay, err := plex.StartReplay(entries, cfg.Replay.Speed)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	for _, server := range cfg.Servers {
+		names[server.URL] = server.Name
+	}
+
+	urls := replay.URLs()
+	recorded := make([]string, 0, len(urls))
+	for url := range urls {
+		recorded = append(recorded, url)
+	}
+	sort.Strings(recorded)
+
+	cfg.Servers = nil
+	for _, url := range recorded {
+		level.Info(log).Log("msg", "replaying recorded server", "server", url, "replay", urls[url])
+		cfg.Servers = append(cfg.Servers, config.Server{
+			URL:   urls[url],
+			Token: "replay",
+			Name:  names[url],
+		})
+	}
+
+	// Counters from a replay must not end up in the real state.
+	cfg.StateFile = ""
+
+	if err := cfg.Validate(); err != nil {
+		replay.Close()
+		return nil, err
+	}
+	return replay, nil
+}
@@ -1,5 +0,0 @@
-#!/usr/bin/env sh
-
-source /plex/token
-
-/prometheus-plex-exporter $@
\ No newline at end of file
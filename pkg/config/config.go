@@ -0,0 +1,382 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+const (
+	DefaultListenAddress   = ":9000"
+	DefaultRefreshInterval = 5 * time.Second
+
+	// How long metrics for sessions are kept after the last update.
+	DefaultSessionTimeout = time.Minute
+
+	DefaultStateInterval = time.Minute
+)
+
+type Config struct {
+	// Address the metrics server listens on.
+	ListenAddress string `yaml:"listen_address"`
+
+	// How often server, library and statistics data is polled. Servers
+	// may override it.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// How long a stopped session keeps being reported before it's pruned.
+	SessionTimeout time.Duration `yaml:"session_timeout"`
+
+	// Where cumulative counters are saved so they survive restarts. State
+	// isn't persisted when empty.
+	StateFile string `yaml:"state_file"`
+
+	// How often the state file is written, in addition to on shutdown.
+	StateInterval time.Duration `yaml:"state_interval"`
+
+	// Per data source polling schedules, keyed by source name.
+	Sources map[string]Source `yaml:"sources"`
+
+	PlayMetrics PlayMetrics `yaml:"play_metrics"`
+
+	Privacy Privacy `yaml:"privacy"`
+
+	Webhook Webhook `yaml:"webhook"`
+
+	// Which libraries are reported, for servers that don't set their own.
+	Libraries Libraries `yaml:"libraries"`
+
+	// Where every response and notification received from the servers is
+	// recorded, for replaying later. Nothing is recorded when empty.
+	RecordFile string `yaml:"record_file"`
+
+	Replay Replay `yaml:"replay"`
+
+	Servers []Server `yaml:"servers"`
+}
+
+type PlayMetrics struct {
+	// session reports one series per play session with every label,
+	// aggregated reports counters rolled up by AggregateLabels, and both
+	// reports both.
+	Mode string `yaml:"mode"`
+
+	// Labels kept by aggregated play metrics, in addition to the server
+	// labels.
+	AggregateLabels []string `yaml:"aggregate_labels"`
+
+	// Labels reported on per-session play metrics, in addition to the
+	// server labels.
+	Labels []string `yaml:"labels"`
+
+	// Labels removed from Labels. Sessions that only differ by dropped
+	// labels are summed into one series.
+	DropLabels []string `yaml:"drop_labels"`
+
+	// Percentage of the media a session has to play through for it to
+	// count as a completed play.
+	CompletedThreshold float64 `yaml:"completed_threshold"`
+}
+
+type Privacy struct {
+	// off exports label values as they are, hash replaces them with a
+	// salted hash.
+	Mode string `yaml:"mode"`
+
+	// Secret mixed into hashes so they can't be reversed by hashing known
+	// names. Changing it changes every hashed value.
+	Salt string `yaml:"salt"`
+
+	// Play labels that are anonymized.
+	Labels []string `yaml:"labels"`
+
+	// Replacement values per label, keyed by the original value. Aliases
+	// apply in any mode and take precedence over hashing.
+	Aliases map[string]map[string]string `yaml:"aliases"`
+}
+
+type Libraries struct {
+	// Names of the libraries to report. Every library is reported when
+	// empty.
+	Include []string `yaml:"include"`
+
+	// Names of libraries that are never reported.
+	Exclude []string `yaml:"exclude"`
+}
+
+type Replay struct {
+	// A capture recorded with record_file. When set, the exporter serves
+	// the recorded servers from the capture instead of connecting to the
+	// configured ones.
+	File string `yaml:"file"`
+
+	// How much faster than real time the capture is played back.
+	Speed float64 `yaml:"speed"`
+}
+
+type Webhook struct {
+	// Serves /webhook on the metrics server to receive Plex webhooks.
+	Enabled bool `yaml:"enabled"`
+
+	// When set, webhook URLs must include it as ?secret=<secret>.
+	Secret string `yaml:"secret"`
+}
+
+// Event sources for session updates.
+const (
+	EventsWebsocket = "websocket"
+	EventsWebhook   = "webhook"
+)
+
+// SourceNames lists the data sources that can be scheduled independently.
+var SourceNames = []string{"libraries", "server_info", "resources", "bandwidth", "dvr", "sessions", "library_items"}
+
+type Source struct {
+	// How often the source is polled. Defaults to the refresh interval,
+	// except for libraries which are polled every 5 minutes and
+	// library_items which is polled hourly.
+	Interval time.Duration `yaml:"interval"`
+
+	// How long a single poll may take. Defaults to 10s, or 30s for
+	// libraries and 5m for library_items.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type Server struct {
+	// The full URL of the server, including scheme and port.
+	URL string `yaml:"url"`
+
+	// A token belonging to the server administrator.
+	Token string `yaml:"token"`
+
+	// A file holding the token instead, such as a Docker secret. It's read
+	// again when it changes.
+	TokenFile string `yaml:"token_file"`
+
+	// Overrides the server label, which defaults to the server's friendly
+	// name.
+	Name string `yaml:"name"`
+
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// Where session updates come from: the notification websocket (the
+	// default), or webhooks sent to the exporter.
+	Events string `yaml:"events"`
+
+	// Overrides the global library filter when set.
+	Libraries *Libraries `yaml:"libraries"`
+}
+
+func Default() *Config {
+	return &Config{
+		ListenAddress:   DefaultListenAddress,
+		RefreshInterval: DefaultRefreshInterval,
+		SessionTimeout:  DefaultSessionTimeout,
+		StateInterval:   DefaultStateInterval,
+		PlayMetrics: PlayMetrics{
+			Mode:            metrics.PlayMetricsSession,
+			AggregateLabels: metrics.DefaultAggregateLabelNames(),
+			Labels:          metrics.DefaultPlayLabelNames(),
+
+			CompletedThreshold: 90,
+		},
+		Replay: Replay{
+			Speed: 1,
+		},
+		Privacy: Privacy{
+			Mode:   metrics.PrivacyOff,
+			Labels: []string{"user", "device", "title", "child_title", "grandchild_title"},
+		},
+	}
+}
+
+// Load reads a YAML config file on top of the defaults.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the config is complete and fills in per-server values
+// that fall back to the global ones.
+func (c *Config) Validate() error {
+	if c.ListenAddress == "" {
+		return errors.New("listen_address must be set")
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive, got %s", c.RefreshInterval)
+	}
+	if c.SessionTimeout <= 0 {
+		return fmt.Errorf("session_timeout must be positive, got %s", c.SessionTimeout)
+	}
+	if c.StateInterval <= 0 {
+		return fmt.Errorf("state_interval must be positive, got %s", c.StateInterval)
+	}
+	if err := c.PlayMetrics.validate(); err != nil {
+		return fmt.Errorf("play_metrics: %w", err)
+	}
+	if err := c.Privacy.validate(); err != nil {
+		return fmt.Errorf("privacy: %w", err)
+	}
+	for name, source := range c.Sources {
+		if !slices.Contains(SourceNames, name) {
+			return fmt.Errorf("sources: unknown source %q, must be one of %s", name, strings.Join(SourceNames, ", "))
+		}
+		if source.Interval < 0 || source.Timeout < 0 {
+			return fmt.Errorf("sources.%s: interval and timeout must be positive", name)
+		}
+	}
+	if c.Replay.File != "" && c.RecordFile != "" {
+		return errors.New("record_file and replay.file cannot both be set")
+	}
+	if c.Replay.Speed <= 0 {
+		return fmt.Errorf("replay.speed must be positive, got %g", c.Replay.Speed)
+	}
+	// Replays bring their own servers.
+	if len(c.Servers) == 0 && c.Replay.File == "" {
+		return errors.New("at least one server must be configured")
+	}
+
+	for i := range c.Servers {
+		server := &c.Servers[i]
+		if err := server.validate(); err != nil {
+			return fmt.Errorf("servers[%d]: %w", i, err)
+		}
+		if server.RefreshInterval == 0 {
+			server.RefreshInterval = c.RefreshInterval
+		}
+		if server.Events == "" {
+			server.Events = EventsWebsocket
+		}
+		if server.Libraries == nil {
+			server.Libraries = &c.Libraries
+		}
+		if server.Events == EventsWebhook && !c.Webhook.Enabled {
+			return fmt.Errorf("servers[%d]: events is %q but the webhook endpoint is not enabled", i, EventsWebhook)
+		}
+	}
+
+	return nil
+}
+
+func (p *PlayMetrics) validate() error {
+	switch p.Mode {
+	case metrics.PlayMetricsSession, metrics.PlayMetricsAggregated, metrics.PlayMetricsBoth:
+	default:
+		return fmt.Errorf("mode must be %s, %s or %s, got %q", metrics.PlayMetricsSession, metrics.PlayMetricsAggregated, metrics.PlayMetricsBoth, p.Mode)
+	}
+
+	if p.Mode != metrics.PlayMetricsSession && len(p.AggregateLabels) == 0 {
+		return errors.New("aggregate_labels must not be empty")
+	}
+
+	if p.CompletedThreshold <= 0 || p.CompletedThreshold > 100 {
+		return fmt.Errorf("completed_threshold must be between 0 and 100, got %g", p.CompletedThreshold)
+	}
+
+	if err := validateLabels("aggregate_labels", p.AggregateLabels); err != nil {
+		return err
+	}
+	if err := validateLabels("labels", p.Labels); err != nil {
+		return err
+	}
+	return validateLabels("drop_labels", p.DropLabels)
+}
+
+func (p *Privacy) validate() error {
+	switch p.Mode {
+	case metrics.PrivacyOff:
+	case metrics.PrivacyHash:
+		if p.Salt == "" {
+			return fmt.Errorf("salt must be set in %s mode", metrics.PrivacyHash)
+		}
+	default:
+		return fmt.Errorf("mode must be %s or %s, got %q", metrics.PrivacyOff, metrics.PrivacyHash, p.Mode)
+	}
+
+	if err := validateLabels("labels", p.Labels); err != nil {
+		return err
+	}
+	for label := range p.Aliases {
+		if !slices.Contains(p.Labels, label) {
+			return fmt.Errorf("aliases: label %q is not anonymized", label)
+		}
+	}
+
+	return nil
+}
+
+// SessionLabels returns the labels reported on per-session play metrics.
+func (p *PlayMetrics) SessionLabels() []string {
+	labels := []string{}
+	for _, label := range p.Labels {
+		if !slices.Contains(p.DropLabels, label) {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func validateLabels(field string, labels []string) error {
+	known := metrics.PlayLabelNames()
+	seen := map[string]bool{}
+	for _, label := range labels {
+		if !slices.Contains(known, label) {
+			return fmt.Errorf("%s: unknown label %q, must be one of %s", field, label, strings.Join(known, ", "))
+		}
+		if seen[label] {
+			return fmt.Errorf("%s: duplicate label %q", field, label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+func (s *Server) validate() error {
+	if s.URL == "" {
+		return errors.New("url must be set")
+	}
+	parsed, err := url.Parse(s.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", s.URL, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", s.URL)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("invalid url %q: missing host", s.URL)
+	}
+	if s.Token == "" && s.TokenFile == "" {
+		return fmt.Errorf("token or token_file must be set for %s", s.URL)
+	}
+	if s.Token != "" && s.TokenFile != "" {
+		return fmt.Errorf("token and token_file cannot both be set for %s", s.URL)
+	}
+	if s.Events != "" && s.Events != EventsWebsocket && s.Events != EventsWebhook {
+		return fmt.Errorf("events must be %s or %s, got %q", EventsWebsocket, EventsWebhook, s.Events)
+	}
+	if s.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must be positive, got %s", s.RefreshInterval)
+	}
+	return nil
+}
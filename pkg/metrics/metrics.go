@@ -33,6 +33,62 @@ var (
 		"session",
 	)
 
+	// Play labels that are only reported when configured.
+	extraPlayLabels = []string{
+		"platform",    // Player platform, such as Android or Roku
+		"location",    // lan or wan
+		"audio_codec", // Streamed audio codec
+		"video_codec", // Streamed video codec
+	}
+
+	completedPlayLabels = append(append([]string(nil), serverLabels...),
+		"library",
+		"media_type",
+		"user",
+	)
+
+	progressLabels = append(append([]string(nil), serverLabels...),
+		"session",
+		"user",
+		"library",
+		"media_type",
+		"title",
+		"child_title",
+		"grandchild_title",
+		"device",
+	)
+
+	bufferingLabels = append(append([]string(nil), serverLabels...),
+		"device_type",
+		"stream_type",
+		"location", // lan or wan
+	)
+
+	sessionBufferingLabels = append(append([]string(nil), serverLabels...),
+		"session",
+		"user",
+		"device",
+		"device_type",
+		"stream_type",
+		"location",
+	)
+
+	sessionBandwidthLabels = append(append([]string(nil), serverLabels...),
+		"session",
+		"user",
+		"device",
+		"location", // lan or wan
+	)
+
+	transcodeLabels = append(append([]string(nil), serverLabels...),
+		"session",
+		"video_decision",     // transcode, copy or empty for audio
+		"source_video_codec", //
+		"video_codec",        // Target video codec
+		"source_audio_codec", //
+		"audio_codec",        // Target audio codec
+	)
+
 	ServerInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "server_info",
 	}, append(append([]string(nil), serverLabels...), "version", "platform", "platform_version"))
@@ -45,6 +101,88 @@ var (
 		Name: "host_mem_util",
 	}, serverLabels)
 
+	ServerProcessCpuUtilization = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_process_cpu_util",
+		Help: "CPU utilization of the media server process",
+	}, serverLabels)
+
+	ServerProcessMemUtilization = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_process_mem_util",
+		Help: "Memory utilization of the media server process",
+	}, serverLabels)
+
+	MetricHostCpuUtilizationMaxDesc = prometheus.NewDesc(
+		"host_cpu_util_max",
+		"Highest host CPU utilization in the latest window of samples",
+		serverLabels,
+		nil,
+	)
+
+	MetricHostMemUtilizationMaxDesc = prometheus.NewDesc(
+		"host_mem_util_max",
+		"Highest host memory utilization in the latest window of samples",
+		serverLabels,
+		nil,
+	)
+
+	MetricProcessCpuUtilizationMaxDesc = prometheus.NewDesc(
+		"server_process_cpu_util_max",
+		"Highest media server process CPU utilization in the latest window of samples",
+		serverLabels,
+		nil,
+	)
+
+	MetricProcessMemUtilizationMaxDesc = prometheus.NewDesc(
+		"server_process_mem_util_max",
+		"Highest media server process memory utilization in the latest window of samples",
+		serverLabels,
+		nil,
+	)
+
+	ServerWebsocketConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_connected",
+		Help: "Whether the exporter is currently subscribed to server notifications",
+	}, serverLabels)
+
+	ServerWebsocketReconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_reconnects_total",
+		Help: "Total reconnection attempts to the server notification websocket",
+	}, serverLabels)
+
+	RefreshLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "refresh_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful refresh of a data source",
+	}, append(append([]string(nil), serverLabels...), "source"))
+
+	RefreshErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "refresh_errors_total",
+		Help: "Total failed refreshes of a data source",
+	}, append(append([]string(nil), serverLabels...), "source"))
+
+	ServerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "server_up",
+		Help: "Whether the last request for server info succeeded",
+	}, serverLabels)
+
+	APIRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_request_duration_seconds",
+		Help:    "Latency of requests to the Plex API",
+		Buckets: prometheus.DefBuckets,
+	}, append(append([]string(nil), serverLabels...),
+		"endpoint", // Request path, with ids replaced by :id
+		"code",     // HTTP status code, or error if no response was received
+	))
+
+	RefreshDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "refresh_duration_seconds",
+		Help: "Duration of the last refresh of a data source",
+	}, append(append([]string(nil), serverLabels...), "source"))
+
+	DVRRecordingFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dvr_recording_failures_total",
+		Help: "Total recordings that failed",
+	}, serverLabels)
+
 	MetricsLibraryDurationTotalDesc = prometheus.NewDesc(
 		"library_duration_total",
 		"Total duration of a library in ms",
@@ -59,17 +197,154 @@ var (
 		nil,
 	)
 
-	MetricPlayCountDesc = prometheus.NewDesc(
-		"plays_total",
-		"Total play counts",
-		playLabels,
+	MetricLibraryItemsDesc = prometheus.NewDesc(
+		"library_items",
+		"Number of items in a library",
+		append(append([]string(nil), libraryLabels...), "item_type"),
 		nil,
 	)
 
-	MetricPlaySecondsTotalDesc = prometheus.NewDesc(
-		"play_seconds_total",
-		"Total play time per session",
-		playLabels,
+	MetricLibraryMediaItemsDesc = prometheus.NewDesc(
+		"library_media_items",
+		"Number of media files in a library by format",
+		append(append([]string(nil), libraryLabels...),
+			"item_type",   // movie, episode or track
+			"resolution",  // Video resolution, empty for music
+			"video_codec", //
+			"audio_codec", //
+			"container",   // File container, such as mkv or mp4
+			"hdr",         // true or false
+		),
+		nil,
+	)
+
+	MetricPlayPositionSecondsDesc = prometheus.NewDesc(
+		"play_position_seconds",
+		"Current playback position of a session",
+		progressLabels,
+		nil,
+	)
+
+	MetricPlayDurationSecondsDesc = prometheus.NewDesc(
+		"play_duration_seconds",
+		"Duration of the media a session is playing",
+		progressLabels,
+		nil,
+	)
+
+	MetricPlayProgressPercentDesc = prometheus.NewDesc(
+		"play_progress_percent",
+		"How far through its media a session is",
+		progressLabels,
+		nil,
+	)
+
+	MetricPlayRemainingSecondsDesc = prometheus.NewDesc(
+		"play_remaining_seconds",
+		"Media time left to play in a session",
+		progressLabels,
+		nil,
+	)
+
+	MetricBufferingEventsTotalDesc = prometheus.NewDesc(
+		"buffering_events_total",
+		"Total times sessions started buffering",
+		bufferingLabels,
+		nil,
+	)
+
+	MetricBufferingSecondsTotalDesc = prometheus.NewDesc(
+		"buffering_seconds_total",
+		"Total time sessions spent buffering",
+		bufferingLabels,
+		nil,
+	)
+
+	MetricSessionBufferingEventsTotalDesc = prometheus.NewDesc(
+		"session_buffering_events_total",
+		"Total times a session started buffering",
+		sessionBufferingLabels,
+		nil,
+	)
+
+	MetricSessionBufferingSecondsTotalDesc = prometheus.NewDesc(
+		"session_buffering_seconds_total",
+		"Total time a session spent buffering",
+		sessionBufferingLabels,
+		nil,
+	)
+
+	MetricBandwidthKbpsDesc = prometheus.NewDesc(
+		"bandwidth_kbps",
+		"Bandwidth used by all sessions, as reported by the server",
+		append(append([]string(nil), serverLabels...), "location"),
+		nil,
+	)
+
+	MetricSessionBandwidthKbpsDesc = prometheus.NewDesc(
+		"session_bandwidth_kbps",
+		"Bandwidth used by a session, as reported by the server",
+		sessionBandwidthLabels,
+		nil,
+	)
+
+	MetricTranscodeSpeedDesc = prometheus.NewDesc(
+		"transcode_speed",
+		"Transcode speed relative to realtime",
+		transcodeLabels,
+		nil,
+	)
+
+	MetricTranscodeThrottledDesc = prometheus.NewDesc(
+		"transcode_throttled",
+		"Whether the transcoder is throttled because it is far enough ahead of playback",
+		transcodeLabels,
+		nil,
+	)
+
+	MetricTranscodeHwRequestedDesc = prometheus.NewDesc(
+		"transcode_hw_requested",
+		"Whether hardware transcoding was requested",
+		transcodeLabels,
+		nil,
+	)
+
+	MetricTranscodeProgressPercentDesc = prometheus.NewDesc(
+		"transcode_progress_percent",
+		"How far through its media a transcode is",
+		transcodeLabels,
+		nil,
+	)
+
+	MetricDVRTunersDesc = prometheus.NewDesc(
+		"dvr_tuners",
+		"Number of tuners of a DVR device",
+		append(append([]string(nil), serverLabels...),
+			"dvr",    // DVR key
+			"device", // Tuner device key
+			"model",  // Device make and model
+		),
+		nil,
+	)
+
+	MetricDVRTunersInUseDesc = prometheus.NewDesc(
+		"dvr_tuners_in_use",
+		"Number of tuners streaming Live TV or recording",
+		serverLabels,
+		nil,
+	)
+
+	MetricDVRRecordingsDesc = prometheus.NewDesc(
+		"dvr_recordings",
+		"Number of scheduled recordings by status",
+		append(append([]string(nil), serverLabels...), "status"),
+		nil,
+	)
+
+	MetricTranscodesActiveDesc = prometheus.NewDesc(
+		"transcodes_active",
+		"Transcodes serving a session that hasn't stopped, including those that have completed",
+		serverLabels,
 		nil,
 	)
 
@@ -78,11 +353,136 @@ var (
 		"Total estimated bytes transmitted",
 		serverLabels, nil)
 
+	MetricSessionsEndedTotal = prometheus.NewDesc(
+		"sessions_ended_total",
+		"Total play sessions that have stopped",
+		serverLabels, nil)
+
+	MetricSessionsEndedPlaySecondsTotal = prometheus.NewDesc(
+		"sessions_ended_play_seconds_total",
+		"Total play time of sessions that have stopped",
+		serverLabels, nil)
+
+	MetricPlaysCompletedTotalDesc = prometheus.NewDesc(
+		"plays_completed_total",
+		"Total plays that reached the completed threshold",
+		completedPlayLabels,
+		nil)
+
 	MetricTransmittedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "transmit_bytes_total",
-	}, serverLabels)
+	}, append(append([]string(nil), serverLabels...),
+		"location", // lan or wan
+		"account",  // Account name
+		"device",   // Device name
+	))
+)
+
+// Play metric modes.
+const (
+	// One series per session, with every play label.
+	PlayMetricsSession = "session"
+	// Counters rolled up by a subset of the play labels.
+	PlayMetricsAggregated = "aggregated"
+	// Both of the above.
+	PlayMetricsBoth = "both"
+)
+
+// Privacy modes for personal play labels.
+const (
+	// Label values are exported as they are.
+	PrivacyOff = "off"
+	// Label values are replaced by a salted hash.
+	PrivacyHash = "hash"
 )
 
+// DefaultAggregateLabelNames lists the labels aggregated play metrics keep
+// unless configured otherwise.
+func DefaultAggregateLabelNames() []string {
+	return []string{"user", "library", "stream_type", "device_type"}
+}
+
+// DefaultPlayLabelNames lists the labels reported on play metrics unless
+// configured otherwise. Server labels are always included.
+func DefaultPlayLabelNames() []string {
+	return withoutServerLabels(playLabels)
+}
+
+// PlayLabelNames lists every label that can be chosen for play metrics.
+func PlayLabelNames() []string {
+	return append(DefaultPlayLabelNames(), extraPlayLabels...)
+}
+
+// CompletedPlayLabelNames lists the labels of completed plays, besides the
+// server labels.
+func CompletedPlayLabelNames() []string {
+	return withoutServerLabels(completedPlayLabels)
+}
+
+// ProgressLabelNames lists the labels of playback progress metrics, besides
+// the server labels.
+func ProgressLabelNames() []string {
+	return withoutServerLabels(progressLabels)
+}
+
+// BufferingLabelNames lists the labels of aggregated buffering metrics,
+// besides the server labels.
+func BufferingLabelNames() []string {
+	return withoutServerLabels(bufferingLabels)
+}
+
+// SessionBufferingLabelNames lists the labels of per session buffering
+// metrics, besides the server labels.
+func SessionBufferingLabelNames() []string {
+	return withoutServerLabels(sessionBufferingLabels)
+}
+
+// SessionBandwidthLabelNames lists the labels of per session bandwidth,
+// besides the server labels.
+func SessionBandwidthLabelNames() []string {
+	return withoutServerLabels(sessionBandwidthLabels)
+}
+
+func withoutServerLabels(labels []string) []string {
+	return append([]string(nil), labels[len(serverLabels):]...)
+}
+
+func NewPlayCountDesc(labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		"plays_total",
+		"Total play counts",
+		append(append([]string(nil), serverLabels...), labels...),
+		nil,
+	)
+}
+
+func NewPlaySecondsTotalDesc(labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		"play_seconds_total",
+		"Total play time per session",
+		append(append([]string(nil), serverLabels...), labels...),
+		nil,
+	)
+}
+
+func NewPlaysAggregatedDesc(labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		"plays_aggregated_total",
+		"Total sessions started, aggregated by the configured play labels",
+		append(append([]string(nil), serverLabels...), labels...),
+		nil,
+	)
+}
+
+func NewPlaySecondsAggregatedDesc(labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		"play_seconds_aggregated_total",
+		"Total play time, aggregated by the configured play labels",
+		append(append([]string(nil), serverLabels...), labels...),
+		nil,
+	)
+}
+
 func Register(collectors ...prometheus.Collector) {
 	prometheus.MustRegister(collectors...)
 }
@@ -112,47 +512,3 @@ func LibraryStorage(value int64,
 		libraryType, libraryName, libraryID,
 	)
 }
-
-func Play(value float64, serverType, serverName, serverID,
-	library, libraryID, libraryType,
-	mediaType,
-	title, childTitle, grandchildTitle,
-	streamType, streamResolution, streamFileResolution, streamBitrate,
-	device, deviceType,
-	user, session string,
-) prometheus.Metric {
-
-	return prometheus.MustNewConstMetric(MetricPlayCountDesc,
-		prometheus.CounterValue,
-		value,
-		serverType, serverName, serverID,
-		library, libraryID, libraryType,
-		mediaType,
-		title, childTitle, grandchildTitle,
-		streamType, streamResolution, streamFileResolution, streamBitrate,
-		device, deviceType,
-		user, session,
-	)
-}
-
-func PlayDuration(value float64, serverType, serverName, serverID,
-	library, libraryID, libraryType,
-	mediaType,
-	title, childTitle, grandchildTitle,
-	streamType, streamResolution, streamFileResolution, streamBitrate,
-	device, deviceType,
-	user, session string,
-) prometheus.Metric {
-
-	return prometheus.MustNewConstMetric(MetricPlaySecondsTotalDesc,
-		prometheus.CounterValue,
-		value,
-		serverType, serverName, serverID,
-		library, libraryID, libraryType,
-		mediaType,
-		title, childTitle, grandchildTitle,
-		streamType, streamResolution, streamFileResolution, streamBitrate,
-		device, deviceType,
-		user, session,
-	)
-}
@@ -0,0 +1,207 @@
+package plex
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithPlayMetrics chooses how play metrics are reported, and which labels
+// aggregated play metrics keep.
+func WithPlayMetrics(mode string, aggregateLabels []string) ServerOption {
+	return func(s *Server) {
+		if mode != "" {
+			s.playMetricsMode = mode
+		}
+		if len(aggregateLabels) > 0 {
+			s.aggregateLabels = aggregateLabels
+		}
+	}
+}
+
+// WithPlayLabels sets the labels reported on per-session play metrics, in
+// addition to the server labels.
+func WithPlayLabels(labels []string) ServerOption {
+	return func(s *Server) {
+		if labels != nil {
+			s.playLabels = labels
+		}
+	}
+}
+
+// aggregate counts events, such as plays or buffering, and their duration
+// for every session sharing the same label values, so it stays monotonic
+// when one of the sessions contributing to it is pruned.
+type aggregate struct {
+	labels   []string
+	count    int64
+	duration time.Duration
+
+	// Sessions that have contributed to the aggregate.
+	sessions map[string]bool
+}
+
+type aggregates struct {
+	desc         *prometheus.Desc
+	secondsDesc  *prometheus.Desc
+	labels       []string
+	byLabelValue map[string]*aggregate
+
+	// Whether aggregates are dropped once every session that contributed
+	// to them is gone. Otherwise they are never pruned.
+	prunable bool
+}
+
+func newAggregates(desc, secondsDesc *prometheus.Desc, labels []string, prunable bool) *aggregates {
+	return &aggregates{
+		desc:         desc,
+		secondsDesc:  secondsDesc,
+		labels:       labels,
+		byLabelValue: map[string]*aggregate{},
+		prunable:     prunable,
+	}
+}
+
+// get returns the aggregate for a set of play label values, creating it if
+// needed.
+func (a *aggregates) get(values map[string]string) *aggregate {
+	labels := pickLabels(a.labels, values)
+	key := strings.Join(labels, "\xff")
+	agg, ok := a.byLabelValue[key]
+	if !ok {
+		agg = &aggregate{labels: labels, sessions: map[string]bool{}}
+		a.byLabelValue[key] = agg
+	}
+	return agg
+}
+
+// session returns the aggregate a session contributes to given its play
+// label values, creating it if needed.
+func (a *aggregates) session(id string, values map[string]string) *aggregate {
+	agg := a.get(values)
+	agg.sessions[id] = true
+	return agg
+}
+
+// prune forgets sessions that are gone, and drops prunable aggregates none
+// of the remaining sessions contributed to.
+func (a *aggregates) prune(sessions map[string]session) {
+	for key, agg := range a.byLabelValue {
+		for id := range agg.sessions {
+			if _, ok := sessions[id]; !ok {
+				delete(agg.sessions, id)
+			}
+		}
+		if a.prunable && len(agg.sessions) == 0 {
+			delete(a.byLabelValue, key)
+		}
+	}
+}
+
+// collect reports every aggregate. inProgress holds time that hasn't been
+// added to the aggregates yet, such as that of sessions still playing.
+func (a *aggregates) collect(ch chan<- prometheus.Metric, serverLabels []string, inProgress map[*aggregate]time.Duration) {
+	for _, agg := range a.byLabelValue {
+		labels := append(append([]string(nil), serverLabels...), agg.labels...)
+		ch <- prometheus.MustNewConstMetric(a.desc, prometheus.CounterValue, float64(agg.count), labels...)
+		ch <- prometheus.MustNewConstMetric(a.secondsDesc, prometheus.CounterValue, (agg.duration + inProgress[agg]).Seconds(), labels...)
+	}
+}
+
+// pickLabels returns the values of the named labels, in order.
+func pickLabels(names []string, values map[string]string) []string {
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = values[name]
+	}
+	return labels
+}
+
+// sessionLabels returns the values of the named play labels of a session,
+// in order. It returns false when the session's library is unknown.
+func (s *sessions) sessionLabels(id string, ss session, names []string) ([]string, bool) {
+	values, ok := s.playLabelValues(id, ss)
+	if !ok {
+		return nil, false
+	}
+	return pickLabels(names, values), true
+}
+
+// playLabelValues returns every play label of a session, except the server
+// labels, keyed by label name. It returns false when the session's library
+// is unknown.
+func (s *sessions) playLabelValues(id string, ss session) (map[string]string, bool) {
+	library := s.server.sessionLibrary(ss)
+	if library == nil {
+		return nil, false
+	}
+
+	title, season, episode := labels(ss.media)
+	values := map[string]string{
+		"library_type":     library.Type,
+		"library":          library.Name,
+		"library_id":       library.ID,
+		"media_type":       ss.media.Type,
+		"title":            title,
+		"child_title":      season,
+		"grandchild_title": episode,
+		"device":           ss.session.Player.Device,
+		"device_type":      ss.session.Player.Product,
+		"platform":         ss.session.Player.Platform,
+		"location":         location(ss.session),
+		"user":             ss.session.User.Title,
+		"session":          id,
+	}
+
+	if len(ss.session.Media) > 0 {
+		values["stream_resolution"] = ss.session.Media[0].VideoResolution
+		values["stream_bitrate"] = strconv.Itoa(ss.session.Media[0].Bitrate)
+		values["audio_codec"] = ss.session.Media[0].AudioCodec
+		values["video_codec"] = ss.session.Media[0].VideoCodec
+		if len(ss.session.Media[0].Part) > 0 {
+			values["stream_type"] = ss.session.Media[0].Part[0].Decision
+		}
+	}
+	if len(ss.media.Media) > 0 {
+		values["stream_file_resolution"] = ss.media.Media[0].VideoResolution
+	}
+
+	s.server.anonymizer.apply(values)
+
+	return values, true
+}
+
+// playAggregates returns the per-session play series and the aggregate a
+// session contributes to given its current labels, and adds the session to
+// them. It returns nil if they can't be determined.
+func (s *sessions) playAggregates(id string, ss session) []*aggregate {
+	values, ok := s.playLabelValues(id, ss)
+	if !ok {
+		return nil
+	}
+
+	var aggs []*aggregate
+	for _, a := range []*aggregates{s.plays, s.aggregatedPlays} {
+		if a != nil {
+			aggs = append(aggs, a.session(id, values))
+		}
+	}
+	return aggs
+}
+
+// playingAggregates returns the time played so far by sessions that are
+// still playing, which hasn't been added to their aggregates yet.
+func (s *sessions) playingAggregates() map[*aggregate]time.Duration {
+	playing := map[*aggregate]time.Duration{}
+	for _, ss := range s.sessions {
+		if ss.state != statePlaying {
+			continue
+		}
+		for _, agg := range ss.plays {
+			playing[agg] += time.Since(ss.playStarted)
+		}
+	}
+	return playing
+}
@@ -0,0 +1,32 @@
+package plex
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes jittered exponential delays between retries.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+
+	attempt int
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d <= 0 || d > b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+
+	// Pick a random delay in [d/2, d] so that exporters restarted at the same
+	// time don't reconnect in lockstep.
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
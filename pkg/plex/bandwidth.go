@@ -0,0 +1,141 @@
+package plex
+
+import (
+	"context"
+	"sort"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+type StatisticsBandwidth struct {
+	AccountID int   `json:"accountID"`
+	DeviceID  int   `json:"deviceID"`
+	At        int   `json:"at"`
+	Lan       bool  `json:"lan"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// BandwidthKey identifies a bandwidth sample. Several samples share a
+// timestamp when more than one account or device is streaming.
+type BandwidthKey struct {
+	At        int  `json:"at"`
+	Lan       bool `json:"lan"`
+	AccountID int  `json:"accountID"`
+	DeviceID  int  `json:"deviceID"`
+}
+
+func (u StatisticsBandwidth) key() BandwidthKey {
+	return BandwidthKey{At: u.At, Lan: u.Lan, AccountID: u.AccountID, DeviceID: u.DeviceID}
+}
+
+// transmitLabels are the labels of transmit_bytes_total, besides the server
+// labels.
+type transmitLabels struct {
+	location string
+	account  string
+	device   string
+}
+
+func (s *Server) refreshBandwidth(ctx context.Context) error {
+	bandwidth := struct {
+		MediaContainer struct {
+			Account []struct {
+				ID   int    `json:"id"`
+				Name string `json:"name"`
+			} `json:"Account"`
+			Device []struct {
+				ID   int    `json:"id"`
+				Name string `json:"name"`
+			} `json:"Device"`
+			StatisticsBandwith []StatisticsBandwidth `json:"StatisticsBandwidth"`
+		} `json:"MediaContainer"`
+	}{}
+	err := s.Client.Get(ctx, "/statistics/bandwidth?timespan=6", &bandwidth)
+
+	// This is a paid feature and API may not be available
+	if err == ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	accounts := map[int]string{}
+	for _, account := range bandwidth.MediaContainer.Account {
+		accounts[account.ID] = account.Name
+	}
+	devices := map[int]string{}
+	for _, device := range bandwidth.MediaContainer.Device {
+		devices[device.ID] = device.Name
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.ingestBandwidth(bandwidth.MediaContainer.StatisticsBandwith, accounts, devices)
+
+	return nil
+}
+
+// ingestBandwidth counts the samples of a bandwidth window that haven't been
+// counted yet. Windows overlap, and samples for a timestamp can show up in
+// a later window than other samples for the same timestamp, so every
+// sample is tracked until it has dropped out of the window. It must be
+// called with s.mtx held.
+func (s *Server) ingestBandwidth(updates []StatisticsBandwidth, accounts, devices map[int]string) {
+	if len(updates) == 0 {
+		return
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].At < updates[j].At
+	})
+
+	for _, u := range updates {
+		key := u.key()
+		if u.At <= s.lastBandwidthAt || s.bandwidthSeen[key] {
+			continue
+		}
+		s.bandwidthSeen[key] = true
+		s.addTransmittedBytes(s.transmitLabels(u, accounts, devices), float64(u.Bytes))
+	}
+
+	// Samples older than the window won't be returned again, so they no
+	// longer need tracking.
+	if oldest := updates[0].At - 1; oldest > s.lastBandwidthAt {
+		s.lastBandwidthAt = oldest
+	}
+	for key := range s.bandwidthSeen {
+		if key.At <= s.lastBandwidthAt {
+			delete(s.bandwidthSeen, key)
+		}
+	}
+}
+
+// transmitLabels returns the labels of a bandwidth update, anonymized like
+// the user and device labels of play metrics.
+func (s *Server) transmitLabels(u StatisticsBandwidth, accounts, devices map[int]string) transmitLabels {
+	values := map[string]string{
+		"user":   accounts[u.AccountID],
+		"device": devices[u.DeviceID],
+	}
+	s.anonymizer.apply(values)
+
+	location := locationWAN
+	if u.Lan {
+		location = locationLAN
+	}
+
+	return transmitLabels{
+		location: location,
+		account:  values["user"],
+		device:   values["device"],
+	}
+}
+
+// addTransmittedBytes must be called with s.mtx held.
+func (s *Server) addTransmittedBytes(labels transmitLabels, bytes float64) {
+	metrics.MetricTransmittedBytesTotal.WithLabelValues("plex", s.Name, s.ID, labels.location, labels.account, labels.device).Add(bytes)
+	s.transmittedBytes[labels] += bytes
+}
@@ -0,0 +1,155 @@
+package plex
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+)
+
+// Counters are global, so every test server gets its own name to keep them
+// apart, even when tests are run several times.
+var bandwidthTestServers atomic.Int64
+
+// newBandwidthTestServer returns a server that hasn't counted any bandwidth
+// sampled after watermark.
+func newBandwidthTestServer(t *testing.T, name string, watermark int) (*Server, *plextest.Server) {
+	t.Helper()
+
+	fake := plextest.NewServer(t)
+	server := newTestServer(t, fake, WithName(fmt.Sprintf("%s-%d", name, bandwidthTestServers.Add(1))))
+
+	server.mtx.Lock()
+	server.lastBandwidthAt = watermark
+	server.mtx.Unlock()
+
+	return server, fake
+}
+
+func setBandwidth(fake *plextest.Server, samples ...plextest.Bandwidth) {
+	fake.Handle("/statistics/bandwidth", plextest.StatisticsBandwidth(samples...))
+}
+
+func transmitted(s *Server, location, account, device string) float64 {
+	return testutil.ToFloat64(metrics.MetricTransmittedBytesTotal.WithLabelValues("plex", s.Name, s.ID, location, account, device))
+}
+
+func refreshBandwidth(t *testing.T, s *Server) {
+	t.Helper()
+	if err := s.refreshBandwidth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBandwidthCountsSamplesOnce(t *testing.T) {
+	s, fake := newBandwidthTestServer(t, "once", 100)
+
+	setBandwidth(fake,
+		plextest.Bandwidth{At: 110, AccountID: 1, DeviceID: 10, Lan: true, Bytes: 1000},
+		plextest.Bandwidth{At: 120, AccountID: 1, DeviceID: 10, Lan: true, Bytes: 2000},
+	)
+	refreshBandwidth(t, s)
+	refreshBandwidth(t, s)
+
+	if got := transmitted(s, "lan", "alice", "Living Room"); got != 3000 {
+		t.Errorf("got %v bytes, want 3000", got)
+	}
+}
+
+func TestBandwidthEmptyWindowKeepsWatermark(t *testing.T) {
+	s, fake := newBandwidthTestServer(t, "empty", 100)
+
+	sample := plextest.Bandwidth{At: 110, AccountID: 2, DeviceID: 20, Bytes: 500}
+	setBandwidth(fake, sample)
+	refreshBandwidth(t, s)
+
+	// A poll without any samples used to reset the watermark, so the next
+	// poll counted the whole window again.
+	setBandwidth(fake)
+	refreshBandwidth(t, s)
+
+	setBandwidth(fake, sample)
+	refreshBandwidth(t, s)
+
+	if got := transmitted(s, "wan", "bob", "Phone"); got != 500 {
+		t.Errorf("got %v bytes, want 500", got)
+	}
+}
+
+func TestBandwidthLateSamplesForSameTimestamp(t *testing.T) {
+	s, fake := newBandwidthTestServer(t, "late", 100)
+
+	first := plextest.Bandwidth{At: 110, AccountID: 1, DeviceID: 10, Lan: true, Bytes: 1000}
+	setBandwidth(fake, first)
+	refreshBandwidth(t, s)
+
+	// Samples for the same timestamp from other devices, accounts and
+	// locations arrive in a later window.
+	setBandwidth(fake,
+		first,
+		plextest.Bandwidth{At: 110, AccountID: 2, DeviceID: 20, Lan: false, Bytes: 300},
+		plextest.Bandwidth{At: 110, AccountID: 1, DeviceID: 10, Lan: false, Bytes: 70},
+	)
+	refreshBandwidth(t, s)
+	refreshBandwidth(t, s)
+
+	tests := []struct {
+		location, account, device string
+		want                      float64
+	}{
+		{"lan", "alice", "Living Room", 1000},
+		{"wan", "bob", "Phone", 300},
+		{"wan", "alice", "Living Room", 70},
+	}
+	for _, tt := range tests {
+		if got := transmitted(s, tt.location, tt.account, tt.device); got != tt.want {
+			t.Errorf("%s/%s/%s: got %v bytes, want %v", tt.location, tt.account, tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestBandwidthSkipsSamplesBeforeWatermark(t *testing.T) {
+	s, fake := newBandwidthTestServer(t, "watermark", 100)
+
+	setBandwidth(fake,
+		plextest.Bandwidth{At: 90, AccountID: 1, DeviceID: 10, Bytes: 1000},
+		plextest.Bandwidth{At: 100, AccountID: 1, DeviceID: 10, Bytes: 1000},
+		plextest.Bandwidth{At: 101, AccountID: 1, DeviceID: 10, Bytes: 5},
+	)
+	refreshBandwidth(t, s)
+
+	if got := transmitted(s, "wan", "alice", "Living Room"); got != 5 {
+		t.Errorf("got %v bytes, want 5", got)
+	}
+}
+
+func TestBandwidthForgetsSamplesOutsideWindow(t *testing.T) {
+	s, fake := newBandwidthTestServer(t, "window", 100)
+
+	setBandwidth(fake,
+		plextest.Bandwidth{At: 110, AccountID: 1, DeviceID: 10, Bytes: 1},
+		plextest.Bandwidth{At: 120, AccountID: 1, DeviceID: 10, Bytes: 2},
+	)
+	refreshBandwidth(t, s)
+
+	setBandwidth(fake,
+		plextest.Bandwidth{At: 120, AccountID: 1, DeviceID: 10, Bytes: 2},
+		plextest.Bandwidth{At: 130, AccountID: 1, DeviceID: 10, Bytes: 4},
+	)
+	refreshBandwidth(t, s)
+
+	if s.lastBandwidthAt != 119 {
+		t.Errorf("got watermark %d, want 119", s.lastBandwidthAt)
+	}
+	if len(s.bandwidthSeen) != 2 {
+		t.Errorf("got %d tracked samples, want 2", len(s.bandwidthSeen))
+	}
+	if got := transmitted(s, "wan", "alice", "Living Room"); got != 7 {
+		t.Errorf("got %v bytes, want 7", got)
+	}
+}
@@ -0,0 +1,92 @@
+package plex
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+var (
+	bufferingLabels        = metrics.BufferingLabelNames()
+	sessionBufferingLabels = metrics.SessionBufferingLabelNames()
+)
+
+// updateBuffering accounts for a session entering or leaving the buffering
+// state.
+func (s *sessions) updateBuffering(id string, ss *session, newState sessionState, now time.Time) {
+	if ss.state == stateBuffering && newState != stateBuffering {
+		stalled := now.Sub(ss.bufferingStarted)
+		ss.bufferingTime += stalled
+		if ss.buffering != nil {
+			ss.buffering.duration += stalled
+		}
+		ss.buffering = nil
+	}
+
+	if ss.state != stateBuffering && newState == stateBuffering {
+		ss.bufferingEvents++
+		ss.bufferingStarted = now
+		// The stall is accounted to the labels it started with.
+		ss.buffering = s.bufferingAggregate(id, *ss)
+		if ss.buffering != nil {
+			ss.buffering.count++
+		}
+	}
+}
+
+// stalled returns the total time a session has spent buffering.
+func (ss session) stalled() time.Duration {
+	stalled := ss.bufferingTime
+	if ss.state == stateBuffering {
+		stalled += time.Since(ss.bufferingStarted)
+	}
+	return stalled
+}
+
+// bufferingAggregate returns the buffering aggregate a session contributes
+// to given its current labels, and adds the session to it. It returns nil if
+// it can't be determined.
+func (s *sessions) bufferingAggregate(id string, ss session) *aggregate {
+	values, ok := s.playLabelValues(id, ss)
+	if !ok {
+		return nil
+	}
+	return s.buffering.session(id, values)
+}
+
+// bufferingInProgress returns the time sessions that are still buffering
+// have stalled for, which hasn't been added to their aggregates yet.
+func (s *sessions) bufferingInProgress() map[*aggregate]time.Duration {
+	inProgress := map[*aggregate]time.Duration{}
+	for _, ss := range s.sessions {
+		if ss.state == stateBuffering && ss.buffering != nil {
+			inProgress[ss.buffering] += time.Since(ss.bufferingStarted)
+		}
+	}
+	return inProgress
+}
+
+func (s *sessions) collectBuffering(ch chan<- prometheus.Metric) {
+	s.buffering.collect(ch, s.serverLabels(), s.bufferingInProgress())
+
+	if s.server.playMetricsMode == metrics.PlayMetricsAggregated {
+		return
+	}
+
+	for id, ss := range s.sessions {
+		if ss.bufferingEvents == 0 {
+			continue
+		}
+
+		labels, ok := s.sessionLabels(id, ss, sessionBufferingLabels)
+		if !ok {
+			continue
+		}
+		labels = append(s.serverLabels(), labels...)
+
+		ch <- prometheus.MustNewConstMetric(metrics.MetricSessionBufferingEventsTotalDesc, prometheus.CounterValue, float64(ss.bufferingEvents), labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricSessionBufferingSecondsTotalDesc, prometheus.CounterValue, ss.stalled().Seconds(), labels...)
+	}
+}
@@ -0,0 +1,190 @@
+package plex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/grafana/plexporter/pkg/redact"
+)
+
+// Kinds of capture entries.
+const (
+	CaptureResponse     = "response"
+	CaptureNotification = "notification"
+	CaptureWebhook      = "webhook"
+)
+
+// CaptureEntry is a line of a capture file: an API response, a websocket
+// notification or a webhook received from a server. Tokens are never recorded.
+type CaptureEntry struct {
+	Time time.Time `json:"time"`
+	// URL of the server as configured.
+	Server string `json:"server"`
+	Kind   string `json:"kind"`
+
+	Method string `json:"method,omitempty"`
+	// Path and query of the request, without the token.
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	// JSON bodies are kept as they are, anything else is kept as text.
+	Body json.RawMessage `json:"body,omitempty"`
+	Text string          `json:"text,omitempty"`
+}
+
+// Recorder writes the traffic of every server to a JSONL capture file, so
+// it can be replayed later.
+type Recorder struct {
+	mtx     sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// WithRecorder records the server's API responses, notifications and
+// webhooks.
+func WithRecorder(r *Recorder) ServerOption {
+	return func(s *Server) {
+		s.recorder = r
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.file.Close()
+}
+
+func (r *Recorder) write(entry CaptureEntry) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	// Recording is best effort, a failed write must not break the
+	// exporter.
+	_ = r.encoder.Encode(entry)
+}
+
+// notification records a websocket frame as it was received.
+func (r *Recorder) notification(server string, frame []byte) {
+	r.message(server, CaptureNotification, frame)
+}
+
+// webhook records the payload of a webhook.
+func (r *Recorder) webhook(server string, payload []byte) {
+	r.message(server, CaptureWebhook, payload)
+}
+
+func (r *Recorder) message(server, kind string, data []byte) {
+	if r == nil {
+		return
+	}
+	entry := CaptureEntry{Time: time.Now(), Server: server, Kind: kind}
+	setCaptureBody(&entry, data)
+	r.write(entry)
+}
+
+// setCaptureBody keeps JSON as it is and anything else as text, with tokens
+// redacted: responses can carry ours, and those of other users.
+func setCaptureBody(entry *CaptureEntry, data []byte) {
+	redacted := redact.String(string(data))
+	if json.Valid([]byte(redacted)) {
+		entry.Body = json.RawMessage(redacted)
+	} else {
+		entry.Text = redacted
+	}
+}
+
+// transport wraps an HTTP transport to record its responses.
+func (r *Recorder) transport(server string, next http.RoundTripper) http.RoundTripper {
+	if r == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &recordingTransport{recorder: r, server: server, next: next}
+}
+
+type recordingTransport struct {
+	recorder *Recorder
+	server   string
+	next     http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry := CaptureEntry{
+		Time:   time.Now(),
+		Server: t.server,
+		Kind:   CaptureResponse,
+		Method: req.Method,
+		Path:   capturePath(req.URL),
+		Status: resp.StatusCode,
+	}
+	setCaptureBody(&entry, body)
+	t.recorder.write(entry)
+
+	return resp, nil
+}
+
+// capturePath returns the path and query of a request URL without the
+// token, which is how responses are looked up on replay.
+func capturePath(u *url.URL) string {
+	query := u.Query()
+	query.Del("X-Plex-Token")
+
+	path := u.EscapedPath()
+	if encoded := query.Encode(); encoded != "" {
+		path += "?" + encoded
+	}
+	return path
+}
+
+// LoadCapture reads the entries of a capture file.
+func LoadCapture(path string) ([]CaptureEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []CaptureEntry
+	scanner := bufio.NewScanner(file)
+	// Library listings make for long lines.
+	scanner.Buffer(nil, 256<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry CaptureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
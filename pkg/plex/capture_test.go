@@ -0,0 +1,162 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+	"github.com/grafana/plexporter/pkg/redact"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake, WithRecorder(recorder))
+	runTestServer(t, fake, server)
+
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 150000))
+	eventually(t, server, "7", statePlaying)
+	notify(t, fake, plextest.Playing("7", "100", "paused", 160000))
+	eventually(t, server, "7", statePaused)
+
+	// Notifications we don't handle are recorded too, with every field.
+	notify(t, fake, plextest.Notification{"type": "reachability", "size": 1, "unknownField": "kept"})
+
+	servers := &Servers{}
+	servers.Add(server)
+	payload := `{"event":"library.new","Server":{"uuid":"` + plextest.MachineIdentifier + `"}}`
+	req, err := webhookRequest(context.Background(), []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewWebhookHandler(servers, "", log.NewNopLogger()).ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := waitForCapture(t, path, func(entries []CaptureEntry) bool {
+		var notified, webhook bool
+		for _, entry := range entries {
+			switch entry.Kind {
+			case CaptureNotification:
+				notified = notified || strings.Contains(string(entry.Body), `"unknownField":"kept"`)
+			case CaptureWebhook:
+				webhook = webhook || string(entry.Body) == payload
+			}
+		}
+		return notified && webhook
+	})
+
+	// Responses can contain our token, and those of other users.
+	fake.Handle("/accounts", map[string]any{
+		"token": plextest.Token,
+		"thumb": "/photo?url=avatar&X-Plex-Token=other-user-token",
+	})
+	var accounts map[string]any
+	if err := server.Client.Get(context.Background(), "/accounts", &accounts); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), plextest.Token) {
+		t.Error("capture contains the token")
+	}
+	if strings.Contains(string(data), "other-user-token") {
+		t.Error("capture contains another user's token")
+	}
+
+	entries, err = LoadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded map[string]string
+	for _, entry := range entries {
+		if entry.Path == "/accounts" {
+			if err := json.Unmarshal(entry.Body, &recorded); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if want := "/photo?url=avatar&X-Plex-Token=" + redact.Placeholder; recorded["token"] != redact.Placeholder || recorded["thumb"] != want {
+		t.Errorf("got recorded accounts %v, want redacted tokens", recorded)
+	}
+
+	replay, err := StartReplay(entries, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+
+	replayURL, ok := replay.URLs()[fake.URL]
+	if !ok {
+		t.Fatalf("%s isn't replayed, got %v", fake.URL, replay.URLs())
+	}
+	replayed, err := NewServer(replayURL, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ID != plextest.MachineIdentifier {
+		t.Errorf("got server id %s, want %s", replayed.ID, plextest.MachineIdentifier)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replayed.Run(ctx, log.NewNopLogger())
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// The capture only spans a few milliseconds, so the session may well be
+	// paused by the time it's checked.
+	eventually(t, replayed, "7", statePaused)
+
+	webhooks := make(chan string, 1)
+	replay.SendWebhooks(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhooks <- r.FormValue("payload")
+	}))
+	if got := <-webhooks; got != payload {
+		t.Errorf("replayed webhook %s, want %s", got, payload)
+	}
+}
+
+// waitForCapture loads the capture until ready accepts its entries, since
+// notifications are recorded asynchronously.
+func waitForCapture(t *testing.T, path string, ready func([]CaptureEntry) bool) []CaptureEntry {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := LoadCapture(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ready(entries) {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("capture isn't complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
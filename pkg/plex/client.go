@@ -1,18 +1,26 @@
 package plex
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+	"github.com/grafana/plexporter/pkg/redact"
 )
 
 var ErrNotFound = errors.New("not found")
 
 type Client struct {
-	Token string
-	URL   *url.URL
+	URL *url.URL
+
+	tokens TokenSource
 
 	httpClient http.Client
 }
@@ -23,29 +31,35 @@ func NewClient(serverURL, token string) (*Client, error) {
 		return nil, err
 	}
 
+	redact.Secret(token)
 	client := &Client{
-		Token:      token,
 		URL:        parsed,
+		tokens:     staticToken(token),
 		httpClient: http.Client{},
 	}
 
 	return client, nil
 }
 
-func (c *Client) NewRequest(method, path string) (*http.Request, error) {
+// Token returns the current token.
+func (c *Client) Token() string {
+	return c.tokens.Token()
+}
+
+func (c *Client) NewRequest(ctx context.Context, method, path string) (*http.Request, error) {
 	requestPath, err := url.Parse(path)
 	if err != nil {
 		return nil, err
 	}
 
 	reqURL := c.URL.ResolveReference(requestPath)
-	req, err := http.NewRequest(method, reqURL.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("X-Plex-Token", c.Token)
+	req.Header.Set("X-Plex-Token", c.Token())
 
 	return req, nil
 }
@@ -53,13 +67,16 @@ func (c *Client) NewRequest(method, path string) (*http.Request, error) {
 func (c *Client) Do(request *http.Request, data any) error {
 	resp, err := c.httpClient.Do(request)
 	if err != nil {
-		return err
+		return redact.Error(err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
+	if resp.StatusCode == http.StatusNotFound {
 		return ErrNotFound
 	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{status: resp.Status, code: resp.StatusCode}
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -69,11 +86,49 @@ func (c *Client) Do(request *http.Request, data any) error {
 	return json.Unmarshal(body, &data)
 }
 
-func (c *Client) Get(path string, data any) error {
-	req, err := c.NewRequest("GET", path)
+func (c *Client) Get(ctx context.Context, path string, data any) error {
+	req, err := c.NewRequest(ctx, "GET", path)
 	if err != nil {
 		return err
 	}
 
 	return c.Do(req, &data)
 }
+
+// timingTransport observes the latency of every request to a server,
+// whichever client makes it.
+type timingTransport struct {
+	server *Server
+	next   http.RoundTripper
+}
+
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	start := time.Now()
+	resp, err := next.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	name, id := t.server.identity()
+	metrics.APIRequestDuration.WithLabelValues("plex", name, id, endpoint(req.URL.Path), code).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// endpoint replaces numeric ids in a request path so it can be used as a
+// low cardinality label.
+func endpoint(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,69 @@
+package plex
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+)
+
+func TestClientErrorStatus(t *testing.T) {
+	fake := plextest.NewServer(t)
+	server := newTestServer(t, fake)
+
+	// Errors are often JSON too, which mustn't pass for a response.
+	fake.Handle("/broken", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("{}"))
+	}))
+
+	before := requestCount(t, "/broken", "503")
+	var data map[string]any
+	err := server.Client.Get(context.Background(), "/broken", &data)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v, want an unexpected status", err)
+	}
+	if n := requestCount(t, "/broken", "503") - before; n != 1 {
+		t.Errorf("got %d requests to /broken, want 1", n)
+	}
+}
+
+func TestListenerRequestsAreTimed(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+
+	before := requestCount(t, "/library/metadata/:id", "200")
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 150000))
+	eventually(t, server, "7", statePlaying)
+
+	if n := requestCount(t, "/library/metadata/:id", "200") - before; n != 1 {
+		t.Errorf("got %d timed metadata requests, want 1", n)
+	}
+}
+
+// requestCount returns how many requests to an endpoint of the fake server
+// were timed. Every test's fake server has the same labels, so tests compare
+// counts before and after their requests.
+func requestCount(t *testing.T, endpoint, code string) uint64 {
+	t.Helper()
+
+	observer, err := metrics.APIRequestDuration.GetMetricWithLabelValues("plex", plextest.FriendlyName, plextest.MachineIdentifier, endpoint, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,84 @@
+package plex
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+// Plex itself marks media as watched at 90%.
+const defaultCompletedThreshold = 90.0
+
+var completedPlayLabels = metrics.CompletedPlayLabelNames()
+
+// WithCompletedThreshold sets the percentage of the media a session has to
+// reach for the play to count as completed.
+func WithCompletedThreshold(percent float64) ServerOption {
+	return func(s *Server) {
+		if percent > 0 {
+			s.completedThreshold = percent
+		}
+	}
+}
+
+type completedPlays struct {
+	labels []string
+	plays  int64
+}
+
+// watched reports whether a session has played far enough through its
+// media to count as completed.
+func (s *sessions) watched(ss session) bool {
+	if ss.media.Duration <= 0 {
+		return false
+	}
+	return float64(ss.session.ViewOffset)/float64(ss.media.Duration)*100 >= s.server.completedThreshold
+}
+
+// complete counts a session's play as completed, unless it already was.
+func (s *sessions) complete(id string, ss *session) {
+	if ss.completedKey != "" && ss.completedKey == ss.media.RatingKey {
+		return
+	}
+
+	labels, ok := s.sessionLabels(id, *ss, completedPlayLabels)
+	if !ok {
+		return
+	}
+
+	s.completedPlays(labels).plays++
+	ss.completedKey = ss.media.RatingKey
+}
+
+// Complete counts a session's play as completed regardless of its progress,
+// for when the server says it was.
+func (s *sessions) Complete(id string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ss, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	s.complete(id, &ss)
+	s.sessions[id] = ss
+}
+
+func (s *sessions) completedPlays(labels []string) *completedPlays {
+	key := strings.Join(labels, "\xff")
+	completed, ok := s.completed[key]
+	if !ok {
+		completed = &completedPlays{labels: labels}
+		s.completed[key] = completed
+	}
+	return completed
+}
+
+func (s *sessions) collectCompleted(ch chan<- prometheus.Metric) {
+	for _, completed := range s.completed {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricPlaysCompletedTotalDesc, prometheus.CounterValue, float64(completed.plays),
+			append(s.serverLabels(), completed.labels...)...)
+	}
+}
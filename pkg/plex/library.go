@@ -1,5 +1,10 @@
 package plex
 
+import (
+	"slices"
+	"strings"
+)
+
 type Library struct {
 	Name string
 	ID   string
@@ -11,13 +16,41 @@ type Library struct {
 	StorageTotal  int64
 }
 
-func isLibraryDirectoryType(directoryType string) bool {
-	switch directoryType {
-	case
-		"movie",
-		"show",
-		"artist":
-		return true
+// Agents used by libraries of personal videos, which Plex reports as movie
+// libraries.
+var homeVideoAgents = []string{"com.plexapp.agents.none", "tv.plex.agents.none"}
+
+// isLibraryDirectory reports whether a media provider directory is a
+// library section, as opposed to hubs, playlists and other views.
+func isLibraryDirectory(id, key string) bool {
+	return id != "" && (key == "" || strings.HasPrefix(key, "/library/sections"))
+}
+
+// libraryType returns the library_type label of a library section.
+func libraryType(directoryType, agent string) string {
+	switch {
+	case directoryType == "movie" && slices.Contains(homeVideoAgents, agent):
+		return "home_video"
+	case directoryType == "":
+		return "other"
+	}
+	return directoryType
+}
+
+// WithLibraryFilter limits the libraries that are reported by name. When
+// include isn't empty only the libraries it lists are reported, and the
+// libraries in exclude are never reported. Sessions playing media from a
+// library that isn't reported are ignored.
+func WithLibraryFilter(include, exclude []string) ServerOption {
+	return func(s *Server) {
+		s.libraryInclude = include
+		s.libraryExclude = exclude
+	}
+}
+
+func (s *Server) reportsLibrary(name string) bool {
+	if len(s.libraryInclude) > 0 && !slices.Contains(s.libraryInclude, name) {
+		return false
 	}
-	return false
+	return !slices.Contains(s.libraryExclude, name)
 }
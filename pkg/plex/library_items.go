@@ -0,0 +1,182 @@
+package plex
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+// Number of items requested per page when listing a library section.
+const libraryPageSize = 500
+
+type itemType struct {
+	name string
+	// Plex metadata type used to filter section listings.
+	id int
+	// Whether items are broken down by their media.
+	media bool
+	// Whether the HDR filter applies to the type.
+	video bool
+}
+
+// Item types counted for each library type.
+var libraryItemTypes = map[string][]itemType{
+	"movie": {
+		{name: "movie", id: 1, media: true, video: true},
+	},
+	"home_video": {
+		{name: "movie", id: 1, media: true, video: true},
+	},
+	"show": {
+		{name: "show", id: 2},
+		{name: "season", id: 3},
+		{name: "episode", id: 4, media: true, video: true},
+	},
+	"artist": {
+		{name: "artist", id: 8},
+		{name: "album", id: 9},
+		{name: "track", id: 10, media: true},
+	},
+}
+
+type mediaKey struct {
+	itemType   string
+	resolution string
+	videoCodec string
+	audioCodec string
+	container  string
+	hdr        bool
+}
+
+type libraryItems struct {
+	counts map[string]int64
+	media  map[mediaKey]int64
+}
+
+type sectionItems struct {
+	MediaContainer struct {
+		TotalSize int `json:"totalSize"`
+		Metadata  []struct {
+			RatingKey string `json:"ratingKey"`
+			Media     []struct {
+				VideoResolution string `json:"videoResolution"`
+				VideoCodec      string `json:"videoCodec"`
+				AudioCodec      string `json:"audioCodec"`
+				Container       string `json:"container"`
+			} `json:"Media"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+func (s *Server) refreshLibraryItems(ctx context.Context) error {
+	s.mtx.Lock()
+	libraries := append([]*Library(nil), s.libraries...)
+	s.mtx.Unlock()
+
+	items := map[string]*libraryItems{}
+	for _, library := range libraries {
+		li, err := s.fetchLibraryItems(ctx, library)
+		if err != nil {
+			return fmt.Errorf("library %s: %w", library.Name, err)
+		}
+		items[library.ID] = li
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.libraryItems = items
+
+	return nil
+}
+
+func (s *Server) fetchLibraryItems(ctx context.Context, library *Library) (*libraryItems, error) {
+	li := &libraryItems{
+		counts: map[string]int64{},
+		media:  map[mediaKey]int64{},
+	}
+
+	for _, t := range libraryItemTypes[library.Type] {
+		if !t.media {
+			var page sectionItems
+			if err := s.Client.Get(ctx, sectionItemsPath(library.ID, t.id, "", 0, 0), &page); err != nil {
+				return nil, err
+			}
+			li.counts[t.name] = int64(page.MediaContainer.TotalSize)
+			continue
+		}
+
+		hdr := map[string]bool{}
+		if t.video {
+			err := s.listSectionItems(ctx, library.ID, t.id, "&hdr=1", func(items sectionItems) {
+				for _, item := range items.MediaContainer.Metadata {
+					hdr[item.RatingKey] = true
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := s.listSectionItems(ctx, library.ID, t.id, "", func(items sectionItems) {
+			for _, item := range items.MediaContainer.Metadata {
+				li.counts[t.name]++
+				for _, media := range item.Media {
+					li.media[mediaKey{
+						itemType:   t.name,
+						resolution: media.VideoResolution,
+						videoCodec: media.VideoCodec,
+						audioCodec: media.AudioCodec,
+						container:  media.Container,
+						hdr:        hdr[item.RatingKey],
+					}]++
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return li, nil
+}
+
+// listSectionItems pages through the items of a type in a library section.
+func (s *Server) listSectionItems(ctx context.Context, sectionID string, typeID int, filter string, fn func(sectionItems)) error {
+	for start := 0; ; start += libraryPageSize {
+		var page sectionItems
+		if err := s.Client.Get(ctx, sectionItemsPath(sectionID, typeID, filter, start, libraryPageSize), &page); err != nil {
+			return err
+		}
+		fn(page)
+
+		if len(page.MediaContainer.Metadata) == 0 || start+libraryPageSize >= page.MediaContainer.TotalSize {
+			return nil
+		}
+	}
+}
+
+func sectionItemsPath(sectionID string, typeID int, filter string, start, size int) string {
+	return fmt.Sprintf("/library/sections/%s/all?type=%d%s&X-Plex-Container-Start=%d&X-Plex-Container-Size=%d", sectionID, typeID, filter, start, size)
+}
+
+func (s *Server) collectLibraryItems(ch chan<- prometheus.Metric, library *Library) {
+	li, ok := s.libraryItems[library.ID]
+	if !ok {
+		return
+	}
+
+	for name, count := range li.counts {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricLibraryItemsDesc, prometheus.GaugeValue, float64(count),
+			"plex", s.Name, s.ID, library.Type, library.Name, library.ID, name)
+	}
+
+	for key, count := range li.media {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricLibraryMediaItemsDesc, prometheus.GaugeValue, float64(count),
+			"plex", s.Name, s.ID, library.Type, library.Name, library.ID,
+			key.itemType, key.resolution, key.videoCodec, key.audioCodec, key.container, strconv.FormatBool(key.hdr))
+	}
+}
@@ -2,21 +2,42 @@ package plex
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/gorilla/websocket"
 	"github.com/jrudio/go-plex-client"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+	"github.com/grafana/plexporter/pkg/redact"
 )
 
 var (
 	ErrAlreadyListening = errors.New("already listening")
 )
 
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+
+	// A connection that stays up at least this long resets the reconnect
+	// backoff.
+	reconnectStableAfter = time.Minute
+
+	// How often the websocket is pinged to notice broken connections, and
+	// how long a ping or close may take to send.
+	notificationPingInterval = 10 * time.Second
+	notificationWriteTimeout = 5 * time.Second
+)
+
+const notificationsPath = "/:/websockets/notifications"
+
 type plexListener struct {
 	server         *Server
 	conn           *plex.Plex
@@ -24,6 +45,9 @@ type plexListener struct {
 	log            log.Logger
 }
 
+// Listen subscribes to the server's notification websocket and keeps the
+// subscription alive until ctx is cancelled, reconnecting with backoff and
+// resyncing server state whenever the connection drops.
 func (s *Server) Listen(ctx context.Context, log log.Logger) error {
 	s.mtx.Lock()
 	if s.listener != nil {
@@ -31,56 +55,151 @@ func (s *Server) Listen(ctx context.Context, log log.Logger) error {
 		return ErrAlreadyListening
 	}
 
-	conn, err := plex.New(s.URL.String(), s.Token)
+	// The connection is kept across reconnects. Its requests, like the
+	// websocket, take the token from the token source, so it's never stale.
+	conn, err := plex.New(s.URL.String(), s.Client.Token())
 	if err != nil {
 		s.mtx.Unlock()
 		return fmt.Errorf("failed to connect to %s: %w", s.URL.String(), err)
 	}
+	conn.HTTPClient.Transport = s.recorder.transport(s.URL.String(), &tokenTransport{tokens: s.Client.tokens, next: &timingTransport{server: s}})
 
 	s.listener = &plexListener{
 		server:         s,
 		conn:           conn,
-		activeSessions: NewSessions(ctx, s),
+		activeSessions: s.sessions,
 		log:            log,
 	}
 
 	s.mtx.Unlock()
 
-	// forward context completion to jrudio/go-plex-client
-	ctrlC := make(chan os.Signal, 1)
-	go func() {
-		<-ctx.Done()
-		close(ctrlC)
-	}()
-
-	doneChan := make(chan error, 1)
-	onError := func(err error) {
-		defer close(doneChan)
-		var closeErr *websocket.CloseError
-		if errors.As(err, &closeErr) {
-			if closeErr.Code == websocket.CloseNormalClosure {
-				return
+	retry := backoff{min: reconnectMinBackoff, max: reconnectMaxBackoff}
+	for {
+		connectedAt := time.Now()
+		err := s.listener.subscribe(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		name, id := s.identity()
+		metrics.ServerWebsocketConnected.WithLabelValues("plex", name, id).Set(0)
+
+		if time.Since(connectedAt) >= reconnectStableAfter {
+			retry.reset()
+		}
+		wait := retry.next()
+		level.Warn(log).Log("msg", "websocket disconnected, reconnecting", "server", name, "backoff", wait, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		metrics.ServerWebsocketReconnectsTotal.WithLabelValues("plex", name, id).Inc()
+
+		// Anything could have changed while we weren't listening.
+		if err := s.Refresh(ctx); err != nil {
+			level.Error(log).Log("msg", "cannot refresh server after reconnect", "server", name, "err", err)
+		}
+	}
+}
+
+// subscribe runs a single websocket subscription until it fails or ctx is
+// cancelled. A normal closure is reported as a nil error.
+func (l *plexListener) subscribe(ctx context.Context) error {
+	ws, err := dialNotifications(ctx, l.server.URL.String(), l.server.Client.Token())
+	if err != nil {
+		return redact.Error(err)
+	}
+	defer ws.Close()
+
+	name, id := l.server.identity()
+	metrics.ServerWebsocketConnected.WithLabelValues("plex", name, id).Set(1)
+	level.Info(l.log).Log("msg", "Successfully connected", "machineID", id, "server", name)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go keepAlive(ctx, ws, stop)
+
+	for {
+		_, frame, err := ws.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
 			}
+			return redact.Error(err)
 		}
-		level.Error(log).Log("msg", "error in websocket processing", "err", err)
-		doneChan <- err
+
+		// Frames are recorded as they are, including notifications we
+		// don't handle, so a replay sees exactly what the server sent.
+		l.server.recorder.notification(l.server.URL.String(), frame)
+		l.handle(frame)
+	}
+}
+
+// dialNotifications opens the notification websocket of a server.
+func dialNotifications(ctx context.Context, serverURL, token string) (*websocket.Conn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
 	}
 
-	events := plex.NewNotificationEvents()
-	events.OnPlaying(s.listener.onPlayingHandler)
+	scheme := "ws"
+	if u.Scheme == "https" {
+		scheme = "wss"
+	}
+	wsURL := url.URL{Scheme: scheme, Host: u.Host, Path: notificationsPath}
+
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), http.Header{"X-Plex-Token": []string{token}})
+	return ws, err
+}
 
-	// TODO - Does this automatically reconnect on websocket failure?
-	conn.SubscribeToNotifications(events, ctrlC, onError)
-	select { // SubscribeToNotifications doesn't return error directly, so we read one from channel without blocking.
-	case err = <-doneChan:
-		return err
-	default:
-		// noop
+// keepAlive pings the websocket until stop is closed, and closes it when
+// ctx is cancelled. Either ends the subscription's read loop.
+func keepAlive(ctx context.Context, ws *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(notificationPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(notificationWriteTimeout)); err != nil {
+				ws.Close()
+				return
+			}
+		case <-ctx.Done():
+			// Ask the server to close the connection, and give up on it
+			// if it doesn't.
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(notificationWriteTimeout))
+			select {
+			case <-stop:
+			case <-time.After(time.Second):
+				ws.Close()
+			}
+			return
+		}
 	}
+}
 
-	level.Info(log).Log("msg", "Successfully connected", "machineID", s.ID, "server", s.Name)
+// handle dispatches a notification frame to the handler of its type. Other
+// types of notifications are ignored.
+func (l *plexListener) handle(frame []byte) {
+	var notification plex.WebsocketNotification
+	if err := json.Unmarshal(frame, &notification); err != nil {
+		level.Warn(l.log).Log("msg", "cannot parse notification", "err", err)
+		return
+	}
 
-	return <-doneChan
+	switch notification.Type {
+	case "playing":
+		l.onPlayingHandler(notification.NotificationContainer)
+	case "transcodeSession.update":
+		l.onTranscodeUpdateHandler(notification.NotificationContainer)
+	}
 }
 
 func getSessionByID(sessions plex.CurrentSessions, sessionID string) *plex.Metadata {
@@ -117,9 +236,14 @@ func (l *plexListener) onPlaying(c plex.NotificationContainer) error {
 			return fmt.Errorf("error getting session with key %s %+v", n.SessionKey, n)
 		}
 
-		metadata, err := l.conn.GetMetadata(n.RatingKey)
-		if err != nil {
-			return fmt.Errorf("error fetching metadata for key %s: %w", n.RatingKey, err)
+		// Live TV isn't in a library, so the session is all there is.
+		media := session
+		if !isLiveTV(*session) {
+			metadata, err := l.conn.GetMetadata(n.RatingKey)
+			if err != nil {
+				return fmt.Errorf("error fetching metadata for key %s: %w", n.RatingKey, err)
+			}
+			media = &metadata.MediaContainer.Metadata[0]
 		}
 
 		level.Info(l.log).Log("msg", "Received PlaySessionStateNotification",
@@ -127,12 +251,30 @@ func (l *plexListener) onPlaying(c plex.NotificationContainer) error {
 			"userName", session.User.Title,
 			"userID", session.User.ID,
 			"state", n.State,
-			"mediaTitle", metadata.MediaContainer.Metadata[0].Title,
-			"mediaID", metadata.MediaContainer.Metadata[0].RatingKey,
+			"mediaTitle", media.Title,
+			"mediaID", media.RatingKey,
 			"timestamp", time.Duration(time.Millisecond)*time.Duration(n.ViewOffset))
 
-		l.activeSessions.Update(n.SessionKey, sessionState(n.State), session, &metadata.MediaContainer.Metadata[0])
+		l.activeSessions.Update(n.SessionKey, sessionState(n.State), session, media)
+		// Sessions can switch between transcoding and direct play.
+		key := ""
+		if n.TranscodeSession != "" {
+			key = transcodeKey(n.TranscodeSession)
+		}
+		l.activeSessions.LinkTranscode(n.SessionKey, key)
 	}
 
 	return nil
 }
+
+func (l *plexListener) onTranscodeUpdateHandler(c plex.NotificationContainer) {
+	for _, ts := range c.TranscodeSession {
+		level.Debug(l.log).Log("msg", "Received TranscodeSession update",
+			"key", ts.Key,
+			"speed", ts.Speed,
+			"throttled", ts.Throttled,
+			"hwRequested", ts.TranscodeHwRequested)
+
+		l.activeSessions.UpdateTranscode(ts)
+	}
+}
@@ -0,0 +1,180 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/jrudio/go-plex-client"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+// Live TV isn't part of any library, so its sessions are reported under a
+// library of their own.
+const (
+	liveTVLibraryID   = "livetv"
+	liveTVLibraryName = "Live TV"
+	liveTVLibraryType = "live_tv"
+)
+
+// Statuses of scheduled recordings.
+const (
+	recordingStatusInProgress = "inprogress"
+	recordingStatusError      = "error"
+)
+
+func isLiveTV(m plex.Metadata) bool {
+	return strings.HasPrefix(m.Key, "/livetv/")
+}
+
+// sessionLibrary returns the library a session plays from, or nil if it's
+// unknown or not reported.
+func (s *Server) sessionLibrary(ss session) *Library {
+	if isLiveTV(ss.session) {
+		if !s.reportsLibrary(liveTVLibraryName) {
+			return nil
+		}
+		return &Library{
+			ID:     liveTVLibraryID,
+			Name:   liveTVLibraryName,
+			Type:   liveTVLibraryType,
+			Server: s,
+		}
+	}
+	return s.Library(ss.media.LibrarySectionID.String())
+}
+
+// liveTVSessions counts the Live TV sessions holding a tuner.
+func (s *sessions) liveTVSessions() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	count := 0
+	for _, ss := range s.sessions {
+		if ss.state != stateStopped && isLiveTV(ss.session) {
+			count++
+		}
+	}
+	return count
+}
+
+// dvrSnapshot is what refreshDVR last read, which is collected as a whole so
+// a scrape never sees part of a refresh.
+type dvrSnapshot struct {
+	tuners      []dvrTuner
+	tunersInUse int
+	recordings  map[string]int
+}
+
+type dvrTuner struct {
+	dvr    string
+	device string
+	model  string
+	tuners int64
+}
+
+func (s *Server) refreshDVR(ctx context.Context) error {
+	dvrs := struct {
+		MediaContainer struct {
+			Dvr []struct {
+				Key    string `json:"key"`
+				Device []struct {
+					Key    string      `json:"key"`
+					Make   string      `json:"make"`
+					Model  string      `json:"model"`
+					Tuners json.Number `json:"tuners"`
+				} `json:"Device"`
+			} `json:"Dvr"`
+		} `json:"MediaContainer"`
+	}{}
+	err := s.Client.Get(ctx, "/livetv/dvrs", &dvrs)
+
+	// DVR is a paid feature and API may not be available
+	if err == ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(dvrs.MediaContainer.Dvr) == 0 {
+		s.mtx.Lock()
+		s.dvr = nil
+		s.mtx.Unlock()
+		return nil
+	}
+
+	snapshot := &dvrSnapshot{recordings: map[string]int{}}
+	for _, dvr := range dvrs.MediaContainer.Dvr {
+		for _, device := range dvr.Device {
+			tuners, _ := device.Tuners.Int64()
+			snapshot.tuners = append(snapshot.tuners, dvrTuner{
+				dvr:    dvr.Key,
+				device: device.Key,
+				model:  strings.TrimSpace(device.Make + " " + device.Model),
+				tuners: tuners,
+			})
+		}
+	}
+
+	scheduled := struct {
+		MediaContainer struct {
+			MediaGrabOperation []struct {
+				Key    string `json:"key"`
+				Status string `json:"status"`
+			} `json:"MediaGrabOperation"`
+		} `json:"MediaContainer"`
+	}{}
+	err = s.Client.Get(ctx, "/media/subscriptions/scheduled", &scheduled)
+	if err != nil {
+		return err
+	}
+
+	failed := map[string]bool{}
+	for _, op := range scheduled.MediaContainer.MediaGrabOperation {
+		snapshot.recordings[op.Status]++
+		if op.Status == recordingStatusError {
+			failed[op.Key] = true
+		}
+	}
+	snapshot.tunersInUse = s.sessions.liveTVSessions() + snapshot.recordings[recordingStatusInProgress]
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.dvr = snapshot
+
+	// Failed recordings stay listed for a while, so only count the ones
+	// we haven't seen before. Those listed at startup failed before we
+	// were watching and aren't counted.
+	failures := metrics.DVRRecordingFailuresTotal.WithLabelValues("plex", s.Name, s.ID)
+	failures.Add(0)
+	if s.failedRecordings != nil {
+		for key := range failed {
+			if !s.failedRecordings[key] {
+				failures.Inc()
+			}
+		}
+	}
+	s.failedRecordings = failed
+
+	return nil
+}
+
+// collectDVR reports the DVRs as of the last refresh. It must be called
+// with s.mtx held.
+func (s *Server) collectDVR(ch chan<- prometheus.Metric) {
+	if s.dvr == nil {
+		return
+	}
+
+	for _, t := range s.dvr.tuners {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricDVRTunersDesc, prometheus.GaugeValue, float64(t.tuners), "plex", s.Name, s.ID, t.dvr, t.device, t.model)
+	}
+	ch <- prometheus.MustNewConstMetric(metrics.MetricDVRTunersInUseDesc, prometheus.GaugeValue, float64(s.dvr.tunersInUse), "plex", s.Name, s.ID)
+	for status, count := range s.dvr.recordings {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricDVRRecordingsDesc, prometheus.GaugeValue, float64(count), "plex", s.Name, s.ID, status)
+	}
+}
@@ -0,0 +1,329 @@
+package plextest
+
+// Library is a library section listed by /media/providers.
+type Library struct {
+	ID            string
+	Title         string
+	Type          string
+	Agent         string
+	DurationTotal int64
+	StorageTotal  int64
+}
+
+// Identity returns the response to /.
+func Identity() map[string]any {
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"friendlyName":      FriendlyName,
+			"machineIdentifier": MachineIdentifier,
+			"version":           "1.40.0.7998",
+			"platform":          "Linux",
+			"platformVersion":   "6.1",
+		},
+	}
+}
+
+// Providers returns the response to /media/providers listing libraries.
+func Providers(libraries ...Library) map[string]any {
+	directories := []map[string]any{
+		// Views that aren't libraries are listed alongside them.
+		{"key": "/hubs", "title": "Recommended"},
+	}
+	for _, library := range libraries {
+		directories = append(directories, map[string]any{
+			"id":            library.ID,
+			"key":           "/library/sections/" + library.ID,
+			"title":         library.Title,
+			"type":          library.Type,
+			"agent":         library.Agent,
+			"durationTotal": library.DurationTotal,
+			"storageTotal":  library.StorageTotal,
+		})
+	}
+
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"friendlyName":      FriendlyName,
+			"machineIdentifier": MachineIdentifier,
+			"version":           "1.40.0.7998",
+			"MediaProvider": []map[string]any{{
+				"identifier": "com.plexapp.plugins.library",
+				"Feature": []map[string]any{
+					{"type": "search"},
+					{"type": "content", "Directory": directories},
+				},
+			}},
+		},
+	}
+}
+
+// Media describes a media item and how a session plays it.
+type Media struct {
+	RatingKey        string
+	LibrarySectionID string
+	Type             string
+	Title            string
+	ParentTitle      string
+	GrandparentTitle string
+	Duration         int
+	Resolution       string
+	Bitrate          int
+}
+
+// Session is an entry of /status/sessions.
+type Session struct {
+	SessionKey string
+	Media      Media
+	User       string
+	Device     string
+	Product    string
+	Platform   string
+	Location   string
+	Bandwidth  int
+	ViewOffset int
+	Decision   string
+}
+
+func (m Media) metadata() map[string]any {
+	return map[string]any{
+		"ratingKey":        m.RatingKey,
+		"key":              "/library/metadata/" + m.RatingKey,
+		"librarySectionID": m.LibrarySectionID,
+		"type":             m.Type,
+		"title":            m.Title,
+		"parentTitle":      m.ParentTitle,
+		"grandparentTitle": m.GrandparentTitle,
+		"duration":         m.Duration,
+		"Media": []map[string]any{{
+			"videoResolution": m.Resolution,
+			"bitrate":         m.Bitrate,
+			"Part":            []map[string]any{{}},
+		}},
+	}
+}
+
+// Metadata returns the response to /library/metadata/<rating key>.
+func Metadata(m Media) map[string]any {
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"size":     1,
+			"Metadata": []map[string]any{m.metadata()},
+		},
+	}
+}
+
+// Sessions returns the response to /status/sessions.
+func Sessions(sessions ...Session) map[string]any {
+	metadata := []map[string]any{}
+	for _, s := range sessions {
+		m := s.Media.metadata()
+		m["sessionKey"] = s.SessionKey
+		m["viewOffset"] = s.ViewOffset
+		m["User"] = map[string]any{"id": "1", "title": s.User}
+		m["Player"] = map[string]any{
+			"device":            s.Device,
+			"product":           s.Product,
+			"platform":          s.Platform,
+			"local":             s.Location == "lan",
+			"machineIdentifier": "player-" + s.SessionKey,
+		}
+		m["Session"] = map[string]any{
+			"id":        "session-" + s.SessionKey,
+			"bandwidth": s.Bandwidth,
+			"location":  s.Location,
+		}
+		m["Media"] = []map[string]any{{
+			"videoResolution": s.Media.Resolution,
+			"bitrate":         s.Media.Bitrate,
+			"Part":            []map[string]any{{"decision": s.Decision}},
+		}}
+		metadata = append(metadata, m)
+	}
+
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"size":     len(metadata),
+			"Metadata": metadata,
+		},
+	}
+}
+
+// Notification is the container of a websocket notification.
+type Notification map[string]any
+
+// Playing returns a notification that a session changed state or position.
+func Playing(sessionKey, ratingKey, state string, viewOffset int64) Notification {
+	return Notification{
+		"type": "playing",
+		"size": 1,
+		"PlaySessionStateNotification": []map[string]any{{
+			"sessionKey": sessionKey,
+			"ratingKey":  ratingKey,
+			"key":        "/library/metadata/" + ratingKey,
+			"state":      state,
+			"viewOffset": viewOffset,
+		}},
+	}
+}
+
+// Transcode describes a transcode session update.
+type Transcode struct {
+	Key              string
+	Speed            float64
+	Throttled        bool
+	Progress         float64
+	Complete         bool
+	VideoDecision    string
+	SourceVideoCodec string
+	VideoCodec       string
+	SourceAudioCodec string
+	AudioCodec       string
+}
+
+// TranscodeUpdate returns a notification that a transcode session
+// progressed.
+func TranscodeUpdate(t Transcode) Notification {
+	return Notification{
+		"type": "transcodeSession.update",
+		"size": 1,
+		"TranscodeSession": []map[string]any{{
+			"key":              t.Key,
+			"speed":            t.Speed,
+			"throttled":        t.Throttled,
+			"progress":         t.Progress,
+			"complete":         t.Complete,
+			"videoDecision":    t.VideoDecision,
+			"sourceVideoCodec": t.SourceVideoCodec,
+			"videoCodec":       t.VideoCodec,
+			"sourceAudioCodec": t.SourceAudioCodec,
+			"audioCodec":       t.AudioCodec,
+		}},
+	}
+}
+
+// PlayingTranscode returns a playing notification for a session served by
+// a transcode session.
+func PlayingTranscode(sessionKey, ratingKey, state string, viewOffset int64, transcodeKey string) Notification {
+	n := Playing(sessionKey, ratingKey, state, viewOffset)
+	n["PlaySessionStateNotification"].([]map[string]any)[0]["transcodeSession"] = transcodeKey
+	return n
+}
+
+// Bandwidth is a sample of /statistics/bandwidth.
+type Bandwidth struct {
+	At        int
+	AccountID int
+	DeviceID  int
+	Lan       bool
+	Bytes     int64
+}
+
+// StatisticsBandwidth returns the response to /statistics/bandwidth. It
+// lists the accounts alice (1) and bob (2), and the devices Living Room (10)
+// and Phone (20).
+func StatisticsBandwidth(samples ...Bandwidth) map[string]any {
+	statistics := []map[string]any{}
+	for _, sample := range samples {
+		statistics = append(statistics, map[string]any{
+			"at":        sample.At,
+			"accountID": sample.AccountID,
+			"deviceID":  sample.DeviceID,
+			"lan":       sample.Lan,
+			"bytes":     sample.Bytes,
+		})
+	}
+
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"Account": []map[string]any{
+				{"id": 1, "name": "alice"},
+				{"id": 2, "name": "bob"},
+			},
+			"Device": []map[string]any{
+				{"id": 10, "name": "Living Room"},
+				{"id": 20, "name": "Phone"},
+			},
+			"StatisticsBandwidth": statistics,
+		},
+	}
+}
+
+// Resources is a sample of /statistics/resources.
+type Resources struct {
+	At             int
+	HostCpuUtil    float64
+	HostMemUtil    float64
+	ProcessCpuUtil float64
+	ProcessMemUtil float64
+}
+
+// StatisticsResources returns the response to /statistics/resources.
+func StatisticsResources(samples ...Resources) map[string]any {
+	statistics := []map[string]any{}
+	for _, sample := range samples {
+		statistics = append(statistics, map[string]any{
+			"at":                       sample.At,
+			"hostCpuUtilization":       sample.HostCpuUtil,
+			"hostMemoryUtilization":    sample.HostMemUtil,
+			"processCpuUtilization":    sample.ProcessCpuUtil,
+			"processMemoryUtilization": sample.ProcessMemUtil,
+		})
+	}
+
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"StatisticsResources": statistics,
+		},
+	}
+}
+
+// DVRDevice is a tuner device of a DVR.
+type DVRDevice struct {
+	Key    string
+	Make   string
+	Model  string
+	Tuners int
+}
+
+// DVRs returns the response to /livetv/dvrs listing a single DVR.
+func DVRs(key string, devices ...DVRDevice) map[string]any {
+	list := []map[string]any{}
+	for _, device := range devices {
+		list = append(list, map[string]any{
+			"key":    device.Key,
+			"make":   device.Make,
+			"model":  device.Model,
+			"tuners": device.Tuners,
+		})
+	}
+
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"Dvr": []map[string]any{{"key": key, "Device": list}},
+		},
+	}
+}
+
+// Recording is a scheduled recording.
+type Recording struct {
+	Key    string
+	Status string
+}
+
+// ScheduledRecordings returns the response to
+// /media/subscriptions/scheduled.
+func ScheduledRecordings(recordings ...Recording) map[string]any {
+	operations := []map[string]any{}
+	for _, recording := range recordings {
+		operations = append(operations, map[string]any{
+			"key":    recording.Key,
+			"status": recording.Status,
+		})
+	}
+
+	return map[string]any{
+		"MediaContainer": map[string]any{
+			"MediaGrabOperation": operations,
+		},
+	}
+}
@@ -0,0 +1,191 @@
+// Package plextest provides a fake Plex Media Server for tests. It serves
+// canned JSON responses over HTTP and pushes scripted notifications to
+// clients subscribed to its notification websocket.
+package plextest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	Token             = "test-token"
+	MachineIdentifier = "fake-machine-id"
+	FriendlyName      = "Fake Server"
+)
+
+const notificationsPath = "/:/websockets/notifications"
+
+// Server is a fake Plex Media Server. Requests for paths without a response
+// get a 404, like endpoints of paid features do on servers without them.
+type Server struct {
+	*httptest.Server
+
+	mtx       sync.Mutex
+	responses map[string]any
+	requests  map[string]int
+	conns     map[*websocket.Conn]bool
+	connected chan struct{}
+}
+
+// NewServer starts a fake server with a Movies and a TV Shows library and
+// no sessions. It's closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		responses: map[string]any{},
+		requests:  map[string]int{},
+		conns:     map[*websocket.Conn]bool{},
+		connected: make(chan struct{}, 1),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	s.Handle("/", Identity())
+	s.Handle("/media/providers", Providers(
+		Library{ID: "1", Title: "Movies", Type: "movie", DurationTotal: 3600000, StorageTotal: 1 << 30},
+		Library{ID: "2", Title: "TV Shows", Type: "show", DurationTotal: 7200000, StorageTotal: 2 << 30},
+	))
+	s.Handle("/status/sessions", Sessions())
+
+	return s
+}
+
+// Handle sets the JSON served for a path, ignoring any query string.
+// Responses that are json.RawMessage or strings are served as they are, and
+// an http.Handler serves the request itself.
+func (s *Server) Handle(path string, response any) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.responses[path] = response
+}
+
+// Remove makes a path return 404.
+func (s *Server) Remove(path string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.responses, path)
+}
+
+// Requests returns how many times a path was requested.
+func (s *Server) Requests(path string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("X-Plex-Token")
+	if token == "" {
+		token = r.URL.Query().Get("X-Plex-Token")
+	}
+	if token != Token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == notificationsPath {
+		s.serveNotifications(w, r)
+		return
+	}
+
+	s.mtx.Lock()
+	s.requests[r.URL.Path]++
+	response, ok := s.responses[r.URL.Path]
+	s.mtx.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if handler, ok := response.(http.Handler); ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch body := response.(type) {
+	case string:
+		w.Write([]byte(body))
+	case json.RawMessage:
+		w.Write(body)
+	default:
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) serveNotifications(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mtx.Lock()
+	s.conns[conn] = true
+	s.mtx.Unlock()
+
+	select {
+	case s.connected <- struct{}{}:
+	default:
+	}
+
+	// Clients send pings as text messages, which are ignored. Reading
+	// also notices when the client goes away.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	s.mtx.Lock()
+	delete(s.conns, conn)
+	s.mtx.Unlock()
+	conn.Close()
+}
+
+// WaitForListener blocks until a client subscribes to notifications, and
+// reports whether one did before the timeout.
+func (s *Server) WaitForListener(timeout time.Duration) bool {
+	select {
+	case <-s.connected:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Notify sends a notification to every subscribed client.
+func (s *Server) Notify(notification Notification) error {
+	data, err := json.Marshal(map[string]any{"NotificationContainer": notification})
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for conn := range s.conns {
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Disconnect drops every subscribed client, as a server restart would.
+func (s *Server) Disconnect() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,192 @@
+package plex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/plexporter/pkg/redact"
+)
+
+const (
+	PlexTVURL = "https://plex.tv"
+
+	// Where users sign in to approve a PIN.
+	PlexTVAuthURL = "https://app.plex.tv/auth"
+
+	plexTVProduct = "Prometheus Plex Exporter"
+)
+
+// PlexTV signs in to plex.tv with the PIN flow: the user approves a PIN in
+// their browser while the exporter polls for the resulting token.
+type PlexTV struct {
+	URL     string
+	AuthURL string
+
+	// Identifies this exporter to plex.tv. A PIN can only be checked with
+	// the identifier it was requested with.
+	ClientIdentifier string
+
+	httpClient http.Client
+}
+
+type PIN struct {
+	ID        int       `json:"id"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	AuthToken string    `json:"authToken"`
+}
+
+// PlexTVServer is a server the account has access to.
+type PlexTVServer struct {
+	Name             string `json:"name"`
+	ClientIdentifier string `json:"clientIdentifier"`
+	Owned            bool   `json:"owned"`
+	Provides         string `json:"provides"`
+	Connections      []struct {
+		URI   string `json:"uri"`
+		Local bool   `json:"local"`
+	} `json:"connections"`
+}
+
+func NewPlexTV() (*PlexTV, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &PlexTV{
+		URL:              PlexTVURL,
+		AuthURL:          PlexTVAuthURL,
+		ClientIdentifier: hex.EncodeToString(id),
+		httpClient:       http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// RequestPIN starts a sign in.
+func (p *PlexTV) RequestPIN(ctx context.Context) (*PIN, error) {
+	var pin PIN
+	if err := p.do(ctx, http.MethodPost, "/api/v2/pins?strong=true", "", &pin); err != nil {
+		return nil, fmt.Errorf("cannot request PIN: %w", err)
+	}
+	return &pin, nil
+}
+
+// LoginURL returns the link the user opens to approve a PIN.
+func (p *PlexTV) LoginURL(pin *PIN) string {
+	params := url.Values{}
+	params.Set("clientID", p.ClientIdentifier)
+	params.Set("code", pin.Code)
+	params.Set("context[device][product]", plexTVProduct)
+	return p.AuthURL + "#?" + params.Encode()
+}
+
+// CheckPIN returns the PIN's token, which is empty until the user has
+// approved it.
+func (p *PlexTV) CheckPIN(ctx context.Context, pin *PIN) (string, error) {
+	var checked PIN
+	if err := p.do(ctx, http.MethodGet, fmt.Sprintf("/api/v2/pins/%d", pin.ID), "", &checked); err != nil {
+		return "", fmt.Errorf("cannot check PIN: %w", err)
+	}
+	redact.Secret(checked.AuthToken)
+	return checked.AuthToken, nil
+}
+
+// WaitForToken checks the PIN every interval until the user approves it,
+// the PIN expires or ctx is cancelled. Network errors and server errors are
+// retried, since the user may take minutes to approve the PIN.
+func (p *PlexTV) WaitForToken(ctx context.Context, pin *PIN, interval time.Duration) (string, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		token, err := p.CheckPIN(ctx, pin)
+		if err != nil && !retryable(err) {
+			return "", err
+		}
+		if token != "" {
+			return token, nil
+		}
+		lastErr = err
+
+		if !pin.ExpiresAt.IsZero() && time.Now().After(pin.ExpiresAt) {
+			if lastErr != nil {
+				return "", fmt.Errorf("PIN %s expired before it was approved: %w", pin.Code, lastErr)
+			}
+			return "", fmt.Errorf("PIN %s expired before it was approved", pin.Code)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// statusError is a response from plex.tv with an unexpected status.
+type statusError struct {
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// retryable tells whether a request may succeed when tried again: anything
+// but a client error, such as an unknown PIN, may be temporary.
+func retryable(err error) bool {
+	var status *statusError
+	return !errors.As(err, &status) || status.code >= 500
+}
+
+// Servers lists the servers the token's account has access to.
+func (p *PlexTV) Servers(ctx context.Context, token string) ([]PlexTVServer, error) {
+	var resources []PlexTVServer
+	if err := p.do(ctx, http.MethodGet, "/api/v2/resources?includeHttps=1", token, &resources); err != nil {
+		return nil, fmt.Errorf("cannot list servers: %w", err)
+	}
+
+	var servers []PlexTVServer
+	for _, resource := range resources {
+		if slices.Contains(strings.Split(resource.Provides, ","), "server") {
+			servers = append(servers, resource)
+		}
+	}
+	return servers, nil
+}
+
+func (p *PlexTV) do(ctx context.Context, method, path, token string, data any) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.URL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Product", plexTVProduct)
+	req.Header.Set("X-Plex-Client-Identifier", p.ClientIdentifier)
+	if token != "" {
+		req.Header.Set("X-Plex-Token", token)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return redact.Error(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{status: resp.Status, code: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
@@ -0,0 +1,129 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlexTVLogin(t *testing.T) {
+	var checks atomic.Int32
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Plex-Client-Identifier") != "test-client" {
+			http.Error(w, "unknown client", http.StatusUnauthorized)
+			return
+		}
+
+		var response any
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v2/pins":
+			response = map[string]any{"id": 42, "code": "abcd", "expiresAt": time.Now().Add(time.Minute)}
+		case r.URL.Path == "/api/v2/pins/42":
+			// Approved on the second check.
+			token := ""
+			if checks.Add(1) > 1 {
+				token = "account-token"
+			}
+			response = map[string]any{"id": 42, "code": "abcd", "authToken": token}
+		case r.URL.Path == "/api/v2/resources" && r.Header.Get("X-Plex-Token") == "account-token":
+			response = []map[string]any{
+				{"name": "Home", "owned": true, "provides": "server", "connections": []map[string]any{{"uri": "http://192.168.0.10:32400", "local": true}}},
+				{"name": "Phone", "provides": "client,player"},
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer fake.Close()
+
+	tv := &PlexTV{URL: fake.URL, AuthURL: PlexTVAuthURL, ClientIdentifier: "test-client"}
+	ctx := context.Background()
+
+	pin, err := tv.RequestPIN(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login := tv.LoginURL(pin); !strings.HasPrefix(login, PlexTVAuthURL+"#?") || !strings.Contains(login, "code=abcd") || !strings.Contains(login, "clientID=test-client") {
+		t.Errorf("unexpected login URL %s", login)
+	}
+
+	token, err := tv.WaitForToken(ctx, pin, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "account-token" {
+		t.Errorf("got token %s, want account-token", token)
+	}
+
+	servers, err := tv.Servers(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Name != "Home" || servers[0].Connections[0].URI != "http://192.168.0.10:32400" {
+		t.Errorf("unexpected servers %+v", servers)
+	}
+}
+
+func TestPlexTVExpiredPIN(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"id": 42, "code": "abcd"})
+	}))
+	defer fake.Close()
+
+	tv := &PlexTV{URL: fake.URL, ClientIdentifier: "test-client"}
+	pin := &PIN{ID: 42, Code: "abcd", ExpiresAt: time.Now().Add(-time.Second)}
+	if _, err := tv.WaitForToken(context.Background(), pin, time.Millisecond); err == nil {
+		t.Error("expected an error waiting on an expired PIN")
+	}
+}
+
+func TestPlexTVRetriesErrors(t *testing.T) {
+	var checks atomic.Int32
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fails, then drops the connection, then hands out the token.
+		switch checks.Add(1) {
+		case 1:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case 2:
+			panic(http.ErrAbortHandler)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"id": 42, "code": "abcd", "authToken": "account-token"})
+		}
+	}))
+	defer fake.Close()
+
+	tv := &PlexTV{URL: fake.URL, ClientIdentifier: "test-client"}
+	pin := &PIN{ID: 42, Code: "abcd", ExpiresAt: time.Now().Add(time.Minute)}
+	token, err := tv.WaitForToken(context.Background(), pin, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "account-token" {
+		t.Errorf("got token %s, want account-token", token)
+	}
+}
+
+func TestPlexTVUnknownPIN(t *testing.T) {
+	var checks atomic.Int32
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer fake.Close()
+
+	tv := &PlexTV{URL: fake.URL, ClientIdentifier: "test-client"}
+	pin := &PIN{ID: 42, Code: "abcd", ExpiresAt: time.Now().Add(time.Minute)}
+	if _, err := tv.WaitForToken(context.Background(), pin, time.Millisecond); err == nil {
+		t.Error("expected an error waiting on an unknown PIN")
+	}
+	if n := checks.Load(); n != 1 {
+		t.Errorf("checked the PIN %d times, want 1", n)
+	}
+}
@@ -0,0 +1,67 @@
+package plex
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+// Length of hashed label values, in hex characters.
+const hashedValueLength = 16
+
+// Anonymizer replaces personal play label values before they're exported.
+// Aliases are applied first, and in hash mode any other value is replaced
+// by a salted hash, which is stable as long as the salt doesn't change.
+type Anonymizer struct {
+	hash    bool
+	salt    []byte
+	labels  []string
+	aliases map[string]map[string]string
+}
+
+// NewAnonymizer returns an anonymizer for the given labels. Aliases map
+// label names to the values to replace and their replacements.
+func NewAnonymizer(mode, salt string, labels []string, aliases map[string]map[string]string) *Anonymizer {
+	return &Anonymizer{
+		hash:    mode == metrics.PrivacyHash,
+		salt:    []byte(salt),
+		labels:  labels,
+		aliases: aliases,
+	}
+}
+
+// WithAnonymizer anonymizes personal labels on every play metric.
+func WithAnonymizer(a *Anonymizer) ServerOption {
+	return func(s *Server) {
+		s.anonymizer = a
+	}
+}
+
+// apply replaces the anonymized labels in values.
+func (a *Anonymizer) apply(values map[string]string) {
+	if a == nil {
+		return
+	}
+
+	for name, value := range values {
+		if value == "" || !slices.Contains(a.labels, name) {
+			continue
+		}
+		if alias, ok := a.aliases[name][value]; ok {
+			values[name] = alias
+			continue
+		}
+		if a.hash {
+			values[name] = a.hashValue(value)
+		}
+	}
+}
+
+func (a *Anonymizer) hashValue(value string) string {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:hashedValueLength]
+}
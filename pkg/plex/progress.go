@@ -0,0 +1,49 @@
+package plex
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+var progressLabels = metrics.ProgressLabelNames()
+
+// position estimates how far into its media a session is. Positions are
+// only reported with session updates, so they're extrapolated while
+// playing.
+func (ss session) position() time.Duration {
+	position := time.Duration(ss.session.ViewOffset) * time.Millisecond
+	if ss.state == statePlaying {
+		position += time.Since(ss.lastUpdate)
+	}
+
+	duration := time.Duration(ss.media.Duration) * time.Millisecond
+	if duration > 0 && position > duration {
+		position = duration
+	}
+	return position
+}
+
+func (s *sessions) collectProgress(ch chan<- prometheus.Metric) {
+	for id, ss := range s.sessions {
+		if ss.state == stateStopped || ss.media.Duration <= 0 {
+			continue
+		}
+
+		labels, ok := s.sessionLabels(id, ss, progressLabels)
+		if !ok {
+			continue
+		}
+		labels = append(s.serverLabels(), labels...)
+
+		duration := time.Duration(ss.media.Duration) * time.Millisecond
+		position := ss.position()
+
+		ch <- prometheus.MustNewConstMetric(metrics.MetricPlayPositionSecondsDesc, prometheus.GaugeValue, position.Seconds(), labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricPlayDurationSecondsDesc, prometheus.GaugeValue, duration.Seconds(), labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricPlayProgressPercentDesc, prometheus.GaugeValue, position.Seconds()/duration.Seconds()*100, labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricPlayRemainingSecondsDesc, prometheus.GaugeValue, (duration - position).Seconds(), labels...)
+	}
+}
@@ -0,0 +1,272 @@
+package plex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Replay serves a capture from local servers standing in for the recorded
+// ones, so the exporter can be run against it offline. Time in the capture
+// starts with the first request and runs speed times faster than real time.
+type Replay struct {
+	speed      float64
+	start, end time.Time
+
+	servers  []*replayServer
+	webhooks []CaptureEntry
+
+	startOnce sync.Once
+	started   time.Time
+	done      chan struct{}
+}
+
+type replayServer struct {
+	replay   *Replay
+	recorded string
+	url      string
+	http     *http.Server
+
+	responses     map[string][]CaptureEntry
+	notifications []CaptureEntry
+
+	mtx  sync.Mutex
+	sent int
+}
+
+// StartReplay starts a server for every server in the capture.
+func StartReplay(entries []CaptureEntry, speed float64) (*Replay, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("capture is empty")
+	}
+	if speed <= 0 {
+		return nil, errors.New("replay speed must be positive")
+	}
+
+	entries = append([]CaptureEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	r := &Replay{
+		speed: speed,
+		start: entries[0].Time,
+		end:   entries[len(entries)-1].Time,
+		done:  make(chan struct{}),
+	}
+
+	byURL := map[string]*replayServer{}
+	for _, entry := range entries {
+		server, ok := byURL[entry.Server]
+		if !ok {
+			server = &replayServer{
+				replay:    r,
+				recorded:  entry.Server,
+				responses: map[string][]CaptureEntry{},
+			}
+			byURL[entry.Server] = server
+			r.servers = append(r.servers, server)
+		}
+
+		switch entry.Kind {
+		case CaptureResponse:
+			key := entry.Method + " " + entry.Path
+			server.responses[key] = append(server.responses[key], entry)
+		case CaptureNotification:
+			server.notifications = append(server.notifications, entry)
+		case CaptureWebhook:
+			r.webhooks = append(r.webhooks, entry)
+		}
+	}
+
+	for _, server := range r.servers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		server.url = "http://" + listener.Addr().String()
+		server.http = &http.Server{Handler: server}
+		go server.http.Serve(listener)
+	}
+
+	return r, nil
+}
+
+// URLs maps the URL of each recorded server to the URL it's replayed on.
+func (r *Replay) URLs() map[string]string {
+	urls := map[string]string{}
+	for _, server := range r.servers {
+		urls[server.recorded] = server.url
+	}
+	return urls
+}
+
+// Done is closed once the replay has reached the end of the capture.
+func (r *Replay) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *Replay) Close() {
+	for _, server := range r.servers {
+		if server.http != nil {
+			server.http.Close()
+		}
+	}
+}
+
+// SendWebhooks posts the recorded webhooks to handler at the time they were
+// received, until ctx is cancelled.
+func (r *Replay) SendWebhooks(ctx context.Context, handler http.Handler) {
+	for _, webhook := range r.webhooks {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.until(webhook.Time)):
+		}
+
+		req, err := webhookRequest(ctx, captureBody(webhook))
+		if err != nil {
+			continue
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// webhookRequest builds a request like those Plex sends webhooks with.
+func webhookRequest(ctx context.Context, payload []byte) (*http.Request, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("payload", string(payload)); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/webhook", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+// captureBody returns the data of an entry as it was received.
+func captureBody(entry CaptureEntry) []byte {
+	if entry.Body != nil {
+		return entry.Body
+	}
+	return []byte(entry.Text)
+}
+
+// now returns the current time in the capture, starting the clock on the
+// first call.
+func (r *Replay) now() time.Time {
+	r.startOnce.Do(func() {
+		r.started = time.Now()
+		time.AfterFunc(time.Duration(float64(r.end.Sub(r.start))/r.speed), func() { close(r.done) })
+	})
+	elapsed := time.Duration(float64(time.Since(r.started)) * r.speed)
+	return r.start.Add(elapsed)
+}
+
+// until returns how long to wait in real time for the capture to reach t.
+func (r *Replay) until(t time.Time) time.Duration {
+	return time.Duration(float64(t.Sub(r.now())) / r.speed)
+}
+
+var replayUpgrader = websocket.Upgrader{}
+
+func (s *replayServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/:/websockets/notifications" {
+		s.serveNotifications(w, req)
+		return
+	}
+
+	// Serve the latest response recorded by now, or the first one for
+	// requests made earlier than in the capture.
+	now := s.replay.now()
+	responses := s.responses[req.Method+" "+capturePath(req.URL)]
+	if len(responses) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	response := responses[0]
+	for _, entry := range responses[1:] {
+		if entry.Time.After(now) {
+			break
+		}
+		response = entry
+	}
+
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if response.Body != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(response.Body)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(response.Text))
+}
+
+// serveNotifications sends the recorded notifications at the time they
+// were received. A client that reconnects picks up where the last one left
+// off.
+func (s *replayServer) serveNotifications(w http.ResponseWriter, req *http.Request) {
+	conn, err := replayUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Reading answers the client's pings and notices when it goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		s.mtx.Lock()
+		next := s.sent
+		s.mtx.Unlock()
+
+		if next == len(s.notifications) {
+			<-closed
+			return
+		}
+		notification := s.notifications[next]
+
+		select {
+		case <-closed:
+			return
+		case <-time.After(s.replay.until(notification.Time)):
+		}
+
+		if err := conn.WriteMessage(websocket.TextMessage, captureBody(notification)); err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		s.sent++
+		s.mtx.Unlock()
+	}
+}
@@ -0,0 +1,186 @@
+package plex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+// Names of the independently scheduled data sources of a server.
+const (
+	SourceLibraries  = "libraries"
+	SourceServerInfo = "server_info"
+	SourceResources  = "resources"
+	SourceBandwidth  = "bandwidth"
+	SourceDVR        = "dvr"
+	SourceSessions   = "sessions"
+
+	SourceLibraryItems = "library_items"
+)
+
+const (
+	defaultRefreshTimeout = 10 * time.Second
+
+	// Storage totals are expensive to compute on large libraries and
+	// rarely change, so they're polled less often by default.
+	defaultLibrariesInterval = 5 * time.Minute
+	defaultLibrariesTimeout  = 30 * time.Second
+
+	// Counting items pages through every library, so it's only done
+	// occasionally.
+	defaultLibraryItemsInterval = time.Hour
+	defaultLibraryItemsTimeout  = 5 * time.Minute
+)
+
+type schedule struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+type refreshSource struct {
+	name     string
+	schedule schedule
+	refresh  func(ctx context.Context) error
+
+	// Background sources are too slow to hold up a resync, so Refresh
+	// skips them and poll refreshes them as soon as it starts instead.
+	background bool
+
+	// Errors of optional sources are counted and logged by poll, but
+	// don't fail Refresh, so a server can be added without them.
+	optional bool
+}
+
+// WithRefreshSchedule overrides how often a single source is polled and how
+// long each poll may take. Zero values keep the defaults.
+func WithRefreshSchedule(source string, interval, timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		sched := s.schedules[source]
+		if interval > 0 {
+			sched.interval = interval
+		}
+		if timeout > 0 {
+			sched.timeout = timeout
+		}
+		s.schedules[source] = sched
+	}
+}
+
+// refreshSources lists the data sources in the order they must be refreshed
+// when resyncing: libraries come first since they also identify the server.
+func (s *Server) refreshSources() []refreshSource {
+	sources := []refreshSource{
+		{name: SourceLibraries, refresh: s.refreshLibraries},
+		{name: SourceServerInfo, refresh: s.refreshServerInfo},
+		{name: SourceResources, refresh: s.refreshResources},
+		{name: SourceBandwidth, refresh: s.refreshBandwidth},
+		{name: SourceDVR, refresh: s.refreshDVR, optional: true},
+		{name: SourceSessions, refresh: s.refreshSessions},
+		{name: SourceLibraryItems, refresh: s.refreshLibraryItems, background: true},
+	}
+
+	for i := range sources {
+		sched := s.schedules[sources[i].name]
+		if sched.interval <= 0 {
+			sched.interval = s.refreshInterval
+		}
+		if sched.timeout <= 0 {
+			sched.timeout = defaultRefreshTimeout
+		}
+		sources[i].schedule = sched
+	}
+
+	return sources
+}
+
+// Refresh polls every data source once, in order, except background
+// sources. Only errors of sources that aren't optional are returned.
+func (s *Server) Refresh(ctx context.Context) error {
+	var errs []error
+	for _, source := range s.refreshSources() {
+		if source.background {
+			continue
+		}
+		if err := s.refreshSource(ctx, source); err != nil && !source.optional {
+			errs = append(errs, fmt.Errorf("%s: %w", source.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) refreshSource(ctx context.Context, source refreshSource) error {
+	ctx, cancel := context.WithTimeout(ctx, source.schedule.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := source.refresh(ctx)
+
+	// Refreshing libraries can change the name and ID, so read them after.
+	name, id := s.identity()
+	if id == "" {
+		// The server never answered, so there's nothing to label metrics
+		// with. The caller reports it down under its configured name.
+		return err
+	}
+
+	metrics.RefreshDuration.WithLabelValues("plex", name, id, source.name).Set(time.Since(start).Seconds())
+
+	if source.name == SourceServerInfo {
+		up := 0.0
+		if err == nil {
+			up = 1.0
+		}
+		metrics.ServerUp.WithLabelValues("plex", name, id).Set(up)
+	}
+
+	if err != nil {
+		metrics.RefreshErrorsTotal.WithLabelValues("plex", name, id, source.name).Inc()
+		return err
+	}
+
+	metrics.RefreshLastSuccess.WithLabelValues("plex", name, id, source.name).SetToCurrentTime()
+	return nil
+}
+
+// poll refreshes every data source on its own schedule until ctx is
+// cancelled.
+func (s *Server) poll(ctx context.Context, log log.Logger) {
+	var wg sync.WaitGroup
+	for _, source := range s.refreshSources() {
+		wg.Add(1)
+		go func(source refreshSource) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(source.schedule.interval)
+			defer ticker.Stop()
+
+			refresh := func() {
+				if err := s.refreshSource(ctx, source); err != nil && ctx.Err() == nil {
+					name, _ := s.identity()
+					level.Error(log).Log("msg", "cannot refresh server", "server", name, "source", source.name, "err", err)
+				}
+			}
+
+			if source.background {
+				refresh()
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					refresh()
+				}
+			}
+		}(source)
+	}
+	wg.Wait()
+}
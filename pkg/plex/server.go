@@ -1,37 +1,113 @@
 package plex
 
 import (
+	"context"
 	"net/url"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/go-kit/log"
+
 	"github.com/grafana/plexporter/pkg/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const defaultRefreshInterval = 5 * time.Second
+
 type Server struct {
 	ID      string
 	Name    string
 	Version string
 
-	Token string
-	URL   *url.URL
+	URL *url.URL
 
 	Client *Client
 
 	listener *plexListener
+	sessions *sessions
+
+	// Maps players and the media they play to session keys for webhook
+	// events, which don't carry a session key.
+	webhookSessions map[string]string
+
+	mtx          sync.Mutex
+	libraries    []*Library
+	libraryItems map[string]*libraryItems
+
+	// Bandwidth samples at or before lastBandwidthAt have been counted or
+	// skipped, and bandwidthSeen holds the samples after it that were
+	// counted.
+	lastBandwidthAt  int
+	bandwidthSeen    map[BandwidthKey]bool
+	transmittedBytes map[transmitLabels]float64
+
+	// Highest utilization of the latest window of resource samples, nil
+	// until one was read.
+	resourcesPeak *StatisticsResources
+
+	sessionBandwidth    []sessionBandwidth
+	bandwidthByLocation map[string]int
+
+	// Keys of the recordings that had failed at the last DVR refresh.
+	failedRecordings map[string]bool
+
+	// DVRs as of the last refresh, nil when the server has none.
+	dvr *dvrSnapshot
+
+	nameOverride    string
+	refreshInterval time.Duration
+	schedules       map[string]schedule
+	sessionTimeout  time.Duration
+	websocket       bool
+	playMetricsMode string
+	aggregateLabels []string
+	playLabels      []string
+	libraryInclude  []string
+	libraryExclude  []string
+	anonymizer      *Anonymizer
+
+	completedThreshold float64
+
+	recorder *Recorder
+}
+
+type ServerOption func(*Server)
+
+// WithName reports the server under the given name instead of its friendly
+// name. An empty name keeps the friendly name.
+func WithName(name string) ServerOption {
+	return func(s *Server) {
+		s.nameOverride = name
+	}
+}
 
-	mtx       sync.Mutex
-	libraries []*Library
+// WithRefreshInterval sets how often sources without their own schedule are
+// polled.
+func WithRefreshInterval(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		if interval > 0 {
+			s.refreshInterval = interval
+		}
+	}
+}
 
-	lastBandwidthAt int
+// WithWebsocket controls whether Run subscribes to the notification
+// websocket. Servers that can't hold a websocket open can report sessions
+// through webhooks instead.
+func WithWebsocket(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.websocket = enabled
+	}
 }
 
-type StatisticsBandwidth struct {
-	At    int   `json:"at"`
-	Lan   bool  `json:"lan"`
-	Bytes int64 `json:"bytes"`
+// WithSessionTimeout sets how long metrics for stopped sessions are kept.
+func WithSessionTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		if timeout > 0 {
+			s.sessionTimeout = timeout
+		}
+	}
 }
 
 type StatisticsResources struct {
@@ -42,39 +118,82 @@ type StatisticsResources struct {
 	ProcessMemUtil float64 `json:"processMemoryUtilization"`
 }
 
-func NewServer(serverURL, token string) (*Server, error) {
+func NewServer(serverURL, token string, opts ...ServerOption) (*Server, error) {
 	client, err := NewClient(serverURL, token)
 	if err != nil {
 		return nil, err
 	}
 
 	server := &Server{
-		URL:   client.URL,
-		Token: client.Token,
-
-		Client:          client,
-		lastBandwidthAt: int(time.Now().Unix()),
+		URL: client.URL,
+
+		Client:           client,
+		lastBandwidthAt:  int(time.Now().Unix()),
+		bandwidthSeen:    map[BandwidthKey]bool{},
+		transmittedBytes: map[transmitLabels]float64{},
+		refreshInterval:  defaultRefreshInterval,
+		schedules: map[string]schedule{
+			SourceLibraries: {interval: defaultLibrariesInterval, timeout: defaultLibrariesTimeout},
+		},
+		sessionTimeout:  defaultSessionTimeout,
+		websocket:       true,
+		playMetricsMode: metrics.PlayMetricsSession,
+		aggregateLabels: metrics.DefaultAggregateLabelNames(),
+		playLabels:      metrics.DefaultPlayLabelNames(),
+		webhookSessions: map[string]string{},
+
+		completedThreshold: defaultCompletedThreshold,
+	}
+	for _, opt := range opts {
+		opt(server)
 	}
+	client.httpClient.Transport = server.recorder.transport(server.URL.String(), &timingTransport{server: server})
+	server.sessions = NewSessions(server)
 
-	err = server.Refresh()
+	err = server.Refresh(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	ticker := time.NewTicker(time.Second * 5)
-	go func() {
-		for range ticker.C {
-			server.Refresh()
-		}
-	}()
-
 	return server, nil
 }
 
-func (s *Server) Refresh() error {
+// identity returns the server's name and ID. Sources refresh concurrently
+// and refreshLibraries may change both, so they're read under the lock.
+func (s *Server) identity() (name, id string) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
+	return s.Name, s.ID
+}
 
+// Run polls the server and listens to its notifications until ctx is
+// cancelled.
+func (s *Server) Run(ctx context.Context, log log.Logger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.sessions.prune(ctx)
+
+	pollDone := make(chan struct{})
+	go func() {
+		defer close(pollDone)
+		s.poll(ctx, log)
+	}()
+
+	if s.websocket {
+		err := s.Listen(ctx, log)
+		if err != nil {
+			cancel()
+			<-pollDone
+			return err
+		}
+	}
+
+	<-pollDone
+	return nil
+}
+
+func (s *Server) refreshLibraries(ctx context.Context) error {
 	container := struct {
 		MediaContainer struct {
 			FriendlyName      string `json:"friendlyName"`
@@ -86,6 +205,8 @@ func (s *Server) Refresh() error {
 					Type        string `json:"type"`
 					Directories []struct {
 						Identifier    string `json:"id"`
+						Key           string `json:"key"`
+						Agent         string `json:"agent"`
 						DurationTotal int64  `json:"durationTotal"`
 						StorageTotal  int64  `json:"storageTotal"`
 						Title         string `json:"title"`
@@ -95,13 +216,19 @@ func (s *Server) Refresh() error {
 			} `json:"MediaProvider"`
 		} `json:"MediaContainer"`
 	}{}
-	err := s.Client.Get("/media/providers?includeStorage=1", &container)
+	err := s.Client.Get(ctx, "/media/providers?includeStorage=1", &container)
 	if err != nil {
 		return err
 	}
 
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
 	s.ID = container.MediaContainer.MachineIdentifier
 	s.Name = container.MediaContainer.FriendlyName
+	if s.nameOverride != "" {
+		s.Name = s.nameOverride
+	}
 	s.Version = container.MediaContainer.Version
 	s.libraries = nil
 	for _, provider := range container.MediaContainer.MediaProviders {
@@ -113,13 +240,13 @@ func (s *Server) Refresh() error {
 				continue
 			}
 			for _, directory := range feature.Directories {
-				if !isLibraryDirectoryType(directory.Type) {
+				if !isLibraryDirectory(directory.Identifier, directory.Key) || !s.reportsLibrary(directory.Title) {
 					continue
 				}
 				s.libraries = append(s.libraries, &Library{
 					ID:            directory.Identifier,
 					Name:          directory.Title,
-					Type:          directory.Type,
+					Type:          libraryType(directory.Type, directory.Agent),
 					DurationTotal: directory.DurationTotal,
 					StorageTotal:  directory.StorageTotal,
 					Server:        s,
@@ -128,25 +255,10 @@ func (s *Server) Refresh() error {
 		}
 	}
 
-	err = s.refreshServerInfo()
-	if err != nil {
-		return err
-	}
-
-	err = s.refreshResources()
-	if err != nil {
-		return err
-	}
-
-	err = s.refreshBandwidth()
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func (s *Server) refreshServerInfo() error {
+func (s *Server) refreshServerInfo(ctx context.Context) error {
 	resp := struct {
 		MediaContainer struct {
 			Version         string `json:"version"`
@@ -154,24 +266,25 @@ func (s *Server) refreshServerInfo() error {
 			PlatformVersion string `json:"platformVersion"`
 		} `json:"MediaContainer"`
 	}{}
-	err := s.Client.Get("/", &resp)
+	err := s.Client.Get(ctx, "/", &resp)
 
 	if err != nil {
 		return err
 	}
 
-	metrics.ServerInfo.WithLabelValues("plex", s.Name, s.ID, resp.MediaContainer.Version, resp.MediaContainer.Platform, resp.MediaContainer.PlatformVersion).Set(1.0)
+	name, id := s.identity()
+	metrics.ServerInfo.WithLabelValues("plex", name, id, resp.MediaContainer.Version, resp.MediaContainer.Platform, resp.MediaContainer.PlatformVersion).Set(1.0)
 
 	return nil
 }
 
-func (s *Server) refreshResources() error {
+func (s *Server) refreshResources(ctx context.Context) error {
 	resources := struct {
 		MediaContainer struct {
 			StatisticsResources []StatisticsResources `json:"StatisticsResources"`
 		} `json:"MediaContainer"`
 	}{}
-	err := s.Client.Get("/statistics/resources?timespan=6", &resources)
+	err := s.Client.Get(ctx, "/statistics/resources?timespan=6", &resources)
 
 	// This is a paid feature and API may not be available
 	if err == ErrNotFound {
@@ -182,60 +295,53 @@ func (s *Server) refreshResources() error {
 		return err
 	}
 
-	if len(resources.MediaContainer.StatisticsResources) > 0 {
-		// The last entry is the most recent
-		i := len(resources.MediaContainer.StatisticsResources) - 1
-		stats := resources.MediaContainer.StatisticsResources[i]
-
-		metrics.ServerHostCpuUtilization.WithLabelValues("plex", s.Name, s.ID).Set(stats.HostCpuUtil)
-		metrics.ServerHostMemUtilization.WithLabelValues("plex", s.Name, s.ID).Set(stats.HostMemUtil)
-	}
-
-	return nil
-}
-
-func (s *Server) refreshBandwidth() error {
-	bandwidth := struct {
-		MediaContainer struct {
-			StatisticsBandwith []StatisticsBandwidth `json:"StatisticsBandwidth"`
-		} `json:"MediaContainer"`
-	}{}
-	err := s.Client.Get("/statistics/bandwidth?timespan=6", &bandwidth)
-
-	// This is a paid feature and API may not be available
-	if err == ErrNotFound {
+	samples := resources.MediaContainer.StatisticsResources
+	if len(samples) == 0 {
 		return nil
 	}
 
-	if err != nil {
-		return err
-	}
-
-	// Record updates newer than our last sync.  We also keep track of
-	// the highest timestamp see and use that as our last sync time.
-	// Sort by timestamp to ensure they are processed in order
-	updates := bandwidth.MediaContainer.StatisticsBandwith
-
-	sort.Slice(updates, func(i, j int) bool {
-		return updates[i].At < updates[j].At
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].At < samples[j].At
 	})
 
-	highest := 0
-	for _, u := range updates {
-		if u.At > s.lastBandwidthAt {
-			metrics.MetricTransmittedBytesTotal.WithLabelValues("plex", s.Name, s.ID).Add(float64(u.Bytes))
-
-			if u.At > highest {
-				highest = u.At
-			}
-		}
+	name, id := s.identity()
+	latest := samples[len(samples)-1]
+	metrics.ServerHostCpuUtilization.WithLabelValues("plex", name, id).Set(latest.HostCpuUtil)
+	metrics.ServerHostMemUtilization.WithLabelValues("plex", name, id).Set(latest.HostMemUtil)
+	metrics.ServerProcessCpuUtilization.WithLabelValues("plex", name, id).Set(latest.ProcessCpuUtil)
+	metrics.ServerProcessMemUtilization.WithLabelValues("plex", name, id).Set(latest.ProcessMemUtil)
+
+	// Several samples are taken between scrapes, so also report the
+	// highest of the window to catch short spikes.
+	peak := latest
+	for _, sample := range samples {
+		peak.HostCpuUtil = max(peak.HostCpuUtil, sample.HostCpuUtil)
+		peak.HostMemUtil = max(peak.HostMemUtil, sample.HostMemUtil)
+		peak.ProcessCpuUtil = max(peak.ProcessCpuUtil, sample.ProcessCpuUtil)
+		peak.ProcessMemUtil = max(peak.ProcessMemUtil, sample.ProcessMemUtil)
 	}
 
-	s.lastBandwidthAt = highest
+	s.mtx.Lock()
+	s.resourcesPeak = &peak
+	s.mtx.Unlock()
 
 	return nil
 }
 
+// collectResourcesPeak reports the highest utilization of the latest window
+// of samples. It must be called with s.mtx held.
+func (s *Server) collectResourcesPeak(ch chan<- prometheus.Metric) {
+	peak := s.resourcesPeak
+	if peak == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(metrics.MetricHostCpuUtilizationMaxDesc, prometheus.GaugeValue, peak.HostCpuUtil, "plex", s.Name, s.ID)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricHostMemUtilizationMaxDesc, prometheus.GaugeValue, peak.HostMemUtil, "plex", s.Name, s.ID)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricProcessCpuUtilizationMaxDesc, prometheus.GaugeValue, peak.ProcessCpuUtil, "plex", s.Name, s.ID)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricProcessMemUtilizationMaxDesc, prometheus.GaugeValue, peak.ProcessMemUtil, "plex", s.Name, s.ID)
+}
+
 func (s *Server) Library(id string) *Library {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -251,10 +357,19 @@ func (s *Server) Library(id string) *Library {
 func (s *Server) Describe(ch chan<- *prometheus.Desc) {
 	ch <- metrics.MetricsLibraryDurationTotalDesc
 	ch <- metrics.MetricsLibraryStorageTotalDesc
-
-	if s.listener != nil {
-		s.listener.activeSessions.Describe(ch)
-	}
+	ch <- metrics.MetricLibraryItemsDesc
+	ch <- metrics.MetricLibraryMediaItemsDesc
+	ch <- metrics.MetricBandwidthKbpsDesc
+	ch <- metrics.MetricSessionBandwidthKbpsDesc
+	ch <- metrics.MetricHostCpuUtilizationMaxDesc
+	ch <- metrics.MetricHostMemUtilizationMaxDesc
+	ch <- metrics.MetricProcessCpuUtilizationMaxDesc
+	ch <- metrics.MetricProcessMemUtilizationMaxDesc
+	ch <- metrics.MetricDVRTunersDesc
+	ch <- metrics.MetricDVRTunersInUseDesc
+	ch <- metrics.MetricDVRRecordingsDesc
+
+	s.sessions.Describe(ch)
 }
 
 func (s *Server) Collect(ch chan<- prometheus.Metric) {
@@ -277,13 +392,16 @@ func (s *Server) Collect(ch chan<- prometheus.Metric) {
 			library.Name,
 			library.ID,
 		)
+		s.collectLibraryItems(ch, library)
 	}
 
+	s.collectSessionBandwidth(ch)
+	s.collectResourcesPeak(ch)
+	s.collectDVR(ch)
+
 	// HACK: Unlock prior to asking sessions to collect since it fetches
 	// 			 libraries by ID, which locks the server mutex
 	s.mtx.Unlock()
 
-	if s.listener != nil {
-		s.listener.activeSessions.Collect(ch)
-	}
+	s.sessions.Collect(ch)
 }
@@ -0,0 +1,547 @@
+package plex
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+)
+
+var heat = plextest.Media{
+	RatingKey:        "100",
+	LibrarySectionID: "1",
+	Type:             "movie",
+	Title:            "Heat",
+	Duration:         600000,
+	Resolution:       "1080",
+	Bitrate:          8000,
+}
+
+var heatSession = plextest.Session{
+	SessionKey: "7",
+	Media:      heat,
+	User:       "alice",
+	Device:     "Living Room",
+	Product:    "Plex for Roku",
+	Platform:   "Roku",
+	Location:   "lan",
+	Bandwidth:  9000,
+	ViewOffset: 150000,
+	Decision:   "directplay",
+}
+
+func newTestServer(t *testing.T, fake *plextest.Server, opts ...ServerOption) *Server {
+	t.Helper()
+
+	server, err := NewServer(fake.URL, plextest.Token, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// runTestServer runs the server until the test finishes, once it listens to
+// notifications.
+func runTestServer(t *testing.T, fake *plextest.Server, server *Server) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Run(ctx, log.NewNopLogger())
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	if !fake.WaitForListener(5 * time.Second) {
+		t.Fatal("server didn't subscribe to notifications")
+	}
+}
+
+func notify(t *testing.T, fake *plextest.Server, n plextest.Notification) {
+	t.Helper()
+	if err := fake.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventuallySession waits for a session to satisfy ready, since
+// notifications are handled asynchronously.
+func eventuallySession(t *testing.T, server *Server, id string, ready func(session) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		server.sessions.mtx.Lock()
+		ss, ok := server.sessions.sessions[id]
+		server.sessions.mtx.Unlock()
+		if ok && ready(ss) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session %s never got the expected update", id)
+}
+
+// eventually waits for a session to reach a state, since notifications are
+// handled asynchronously.
+func eventually(t *testing.T, server *Server, id string, state sessionState) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		server.sessions.mtx.Lock()
+		got := server.sessions.sessions[id].state
+		server.sessions.mtx.Unlock()
+		if got == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session %s never became %s", id, state)
+}
+
+func compareMetrics(t *testing.T, server *Server, expected string, names ...string) {
+	t.Helper()
+	if err := testutil.CollectAndCompare(server, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerLibraries(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/media/providers", plextest.Providers(
+		plextest.Library{ID: "1", Title: "Movies", Type: "movie", DurationTotal: 3600000, StorageTotal: 1000},
+		plextest.Library{ID: "3", Title: "Photos", Type: "photo", StorageTotal: 500},
+		plextest.Library{ID: "4", Title: "Home Videos", Type: "movie", Agent: "tv.plex.agents.none", StorageTotal: 200},
+		plextest.Library{ID: "5", Title: "Hidden", Type: "movie", StorageTotal: 100},
+	))
+
+	server := newTestServer(t, fake, WithLibraryFilter(nil, []string{"Hidden"}))
+
+	if server.ID != plextest.MachineIdentifier || server.Name != plextest.FriendlyName {
+		t.Errorf("got server %s (%s), want %s (%s)", server.Name, server.ID, plextest.FriendlyName, plextest.MachineIdentifier)
+	}
+
+	compareMetrics(t, server, `
+# HELP library_storage_total Total storage size of a library in Bytes
+# TYPE library_storage_total gauge
+library_storage_total{library="Home Videos",library_id="4",library_type="home_video",server="Fake Server",server_id="fake-machine-id",server_type="plex"} 200
+library_storage_total{library="Movies",library_id="1",library_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex"} 1000
+library_storage_total{library="Photos",library_id="3",library_type="photo",server="Fake Server",server_id="fake-machine-id",server_type="plex"} 500
+`, "library_storage_total")
+}
+
+// Sources are polled concurrently, and refreshing libraries updates the
+// name and ID every other source labels its metrics with. Run with -race.
+func TestServerPollsSourcesConcurrently(t *testing.T) {
+	fake := plextest.NewServer(t)
+
+	server := newTestServer(t, fake,
+		WithRefreshInterval(time.Millisecond),
+		WithRefreshSchedule(SourceLibraries, time.Millisecond, 0))
+	runTestServer(t, fake, server)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Requests("/media/providers") < 10 || fake.Requests("/") < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("sources weren't polled")
+		}
+		testutil.CollectAndCount(server)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerResourcesPeak(t *testing.T) {
+	fake := plextest.NewServer(t)
+	server := newTestServer(t, fake)
+
+	refresh := func(samples ...plextest.Resources) {
+		t.Helper()
+		fake.Handle("/statistics/resources", plextest.StatisticsResources(samples...))
+		if err := server.refreshResources(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := func(peak string) string {
+		return `
+# HELP host_cpu_util_max Highest host CPU utilization in the latest window of samples
+# TYPE host_cpu_util_max gauge
+host_cpu_util_max{server="Fake Server",server_id="fake-machine-id",server_type="plex"} ` + peak + `
+`
+	}
+
+	// The spike is reported while it's in the window, however often it's
+	// scraped.
+	refresh(plextest.Resources{At: 100, HostCpuUtil: 10}, plextest.Resources{At: 105, HostCpuUtil: 80})
+	compareMetrics(t, server, expected("80"), "host_cpu_util_max")
+	compareMetrics(t, server, expected("80"), "host_cpu_util_max")
+
+	refresh(plextest.Resources{At: 105, HostCpuUtil: 80}, plextest.Resources{At: 110, HostCpuUtil: 20})
+	compareMetrics(t, server, expected("80"), "host_cpu_util_max")
+
+	refresh(plextest.Resources{At: 110, HostCpuUtil: 20}, plextest.Resources{At: 115, HostCpuUtil: 30})
+	compareMetrics(t, server, expected("30"), "host_cpu_util_max")
+	compareMetrics(t, server, expected("30"), "host_cpu_util_max")
+}
+
+func TestServerReportsDVR(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/livetv/dvrs", plextest.DVRs("1", plextest.DVRDevice{Key: "10", Make: "Silicondust", Model: "HDHomeRun", Tuners: 4}))
+	fake.Handle("/media/subscriptions/scheduled", plextest.ScheduledRecordings(
+		plextest.Recording{Key: "a", Status: "scheduled"},
+		plextest.Recording{Key: "b", Status: "scheduled"},
+		plextest.Recording{Key: "c", Status: "inprogress"},
+	))
+	server := newTestServer(t, fake)
+
+	expected := `
+# HELP dvr_recordings Number of scheduled recordings by status
+# TYPE dvr_recordings gauge
+dvr_recordings{server="Fake Server",server_id="fake-machine-id",server_type="plex",status="inprogress"} 1
+dvr_recordings{server="Fake Server",server_id="fake-machine-id",server_type="plex",status="scheduled"} 2
+# HELP dvr_tuners Number of tuners of a DVR device
+# TYPE dvr_tuners gauge
+dvr_tuners{device="10",dvr="1",model="Silicondust HDHomeRun",server="Fake Server",server_id="fake-machine-id",server_type="plex"} 4
+# HELP dvr_tuners_in_use Number of tuners streaming Live TV or recording
+# TYPE dvr_tuners_in_use gauge
+dvr_tuners_in_use{server="Fake Server",server_id="fake-machine-id",server_type="plex"} 1
+`
+	names := []string{"dvr_recordings", "dvr_tuners", "dvr_tuners_in_use"}
+	compareMetrics(t, server, expected, names...)
+
+	// A refresh that fails halfway keeps reporting the last complete one.
+	fake.Handle("/livetv/dvrs", plextest.DVRs("1", plextest.DVRDevice{Key: "20", Make: "Silicondust", Model: "HDHomeRun", Tuners: 2}))
+	fake.Handle("/media/subscriptions/scheduled", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	if err := server.refreshDVR(context.Background()); err == nil {
+		t.Error("expected an error refreshing the DVR")
+	}
+	compareMetrics(t, server, expected, names...)
+}
+
+func TestServerWithBrokenDVR(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/livetv/dvrs", "{")
+
+	// DVR is optional, so failing to read it doesn't fail the server.
+	newTestServer(t, fake)
+}
+
+func TestServerUnauthorized(t *testing.T) {
+	fake := plextest.NewServer(t)
+
+	if _, err := NewServer(fake.URL, "wrong-token"); err == nil {
+		t.Error("expected an error connecting with the wrong token")
+	}
+}
+
+func TestListenerReportsPlays(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 150000))
+	eventually(t, server, "7", statePlaying)
+
+	compareMetrics(t, server, `
+# HELP plays_total Total play counts
+# TYPE plays_total counter
+plays_total{child_title="",device="Living Room",device_type="Plex for Roku",grandchild_title="",library="Movies",library_id="1",library_type="movie",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",stream_bitrate="8000",stream_file_resolution="1080",stream_resolution="1080",stream_type="directplay",title="Heat",user="alice"} 1
+`, "plays_total")
+
+	notify(t, fake, plextest.Playing("7", "100", "stopped", 160000))
+	eventually(t, server, "7", stateStopped)
+
+	compareMetrics(t, server, `
+# HELP sessions_ended_total Total play sessions that have stopped
+# TYPE sessions_ended_total counter
+sessions_ended_total{server="Fake Server",server_id="fake-machine-id",server_type="plex"} 1
+`, "sessions_ended_total")
+}
+
+func TestListenerPlayLabelsAtPlayStart(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 150000))
+	eventually(t, server, "7", statePlaying)
+
+	// The stream's quality drops during playback.
+	lower := heatSession
+	lower.Media.Resolution = "720"
+	lower.Media.Bitrate = 4000
+	fake.Handle("/status/sessions", plextest.Sessions(lower))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 155000))
+	eventuallySession(t, server, "7", func(ss session) bool {
+		return ss.session.Media[0].VideoResolution == "720"
+	})
+
+	// The session stays in the series it started playing in.
+	compareMetrics(t, server, `
+# HELP plays_total Total play counts
+# TYPE plays_total counter
+plays_total{child_title="",device="Living Room",device_type="Plex for Roku",grandchild_title="",library="Movies",library_id="1",library_type="movie",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",stream_bitrate="8000",stream_file_resolution="1080",stream_resolution="1080",stream_type="directplay",title="Heat",user="alice"} 1
+`, "plays_total")
+	if n := testutil.CollectAndCount(server, "play_seconds_total"); n != 1 {
+		t.Errorf("got %d play_seconds_total series, want 1", n)
+	}
+}
+
+func TestListenerMergedPlaysSurvivePruning(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake, WithPlayLabels([]string{"user", "library"}), WithSessionTimeout(time.Nanosecond))
+	runTestServer(t, fake, server)
+
+	other := heatSession
+	other.SessionKey = "8"
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession, other))
+	for _, id := range []string{"7", "8"} {
+		notify(t, fake, plextest.Playing(id, "100", "playing", 150000))
+		eventually(t, server, id, statePlaying)
+	}
+
+	expected := `
+# HELP plays_total Total play counts
+# TYPE plays_total counter
+plays_total{library="Movies",server="Fake Server",server_id="fake-machine-id",server_type="plex",user="alice"} 2
+`
+	compareMetrics(t, server, expected, "plays_total")
+
+	// Pruning one of the sessions sharing the series doesn't make it go
+	// down.
+	notify(t, fake, plextest.Playing("7", "100", "stopped", 160000))
+	eventually(t, server, "7", stateStopped)
+	server.sessions.pruneOldSessions()
+	compareMetrics(t, server, expected, "plays_total")
+
+	// The series is dropped along with the last of its sessions.
+	notify(t, fake, plextest.Playing("8", "100", "stopped", 160000))
+	eventually(t, server, "8", stateStopped)
+	server.sessions.pruneOldSessions()
+	compareMetrics(t, server, "", "plays_total")
+}
+
+func TestListenerConfiguredLabelsAtPlayStart(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake, WithPlayLabels([]string{"user", "location"}), WithSessionTimeout(time.Nanosecond))
+	runTestServer(t, fake, server)
+
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 150000))
+	eventually(t, server, "7", statePlaying)
+
+	// The player moves off the local network during playback.
+	remote := heatSession
+	remote.Location = "wan"
+	fake.Handle("/status/sessions", plextest.Sessions(remote))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 155000))
+	eventuallySession(t, server, "7", func(ss session) bool {
+		return ss.session.Session.Location == "wan"
+	})
+
+	compareMetrics(t, server, `
+# HELP plays_total Total play counts
+# TYPE plays_total counter
+plays_total{location="lan",server="Fake Server",server_id="fake-machine-id",server_type="plex",user="alice"} 1
+`, "plays_total")
+	if n := testutil.CollectAndCount(server, "play_seconds_total"); n != 1 {
+		t.Errorf("got %d play_seconds_total series, want 1", n)
+	}
+
+	// The series is still dropped along with the session.
+	notify(t, fake, plextest.Playing("7", "100", "stopped", 160000))
+	eventually(t, server, "7", stateStopped)
+	server.sessions.pruneOldSessions()
+	compareMetrics(t, server, "", "plays_total")
+}
+
+func TestListenerReportsProgress(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+
+	// Paused sessions don't move, so their progress is exact.
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	notify(t, fake, plextest.Playing("7", "100", "paused", 150000))
+	eventually(t, server, "7", statePaused)
+
+	labels := `{child_title="",device="Living Room",grandchild_title="",library="Movies",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",title="Heat",user="alice"}`
+	compareMetrics(t, server, `
+# HELP play_position_seconds Current playback position of a session
+# TYPE play_position_seconds gauge
+play_position_seconds`+labels+` 150
+# HELP play_duration_seconds Duration of the media a session is playing
+# TYPE play_duration_seconds gauge
+play_duration_seconds`+labels+` 600
+# HELP play_progress_percent How far through its media a session is
+# TYPE play_progress_percent gauge
+play_progress_percent`+labels+` 25
+# HELP play_remaining_seconds Media time left to play in a session
+# TYPE play_remaining_seconds gauge
+play_remaining_seconds`+labels+` 450
+`, "play_position_seconds", "play_duration_seconds", "play_progress_percent", "play_remaining_seconds")
+}
+
+func TestListenerReportsBuffering(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+	for _, state := range []sessionState{statePlaying, stateBuffering, statePlaying} {
+		notify(t, fake, plextest.Playing("7", "100", string(state), 150000))
+		eventually(t, server, "7", state)
+	}
+
+	compareMetrics(t, server, `
+# HELP buffering_events_total Total times sessions started buffering
+# TYPE buffering_events_total counter
+buffering_events_total{device_type="Plex for Roku",location="lan",server="Fake Server",server_id="fake-machine-id",server_type="plex",stream_type="directplay"} 1
+# HELP session_buffering_events_total Total times a session started buffering
+# TYPE session_buffering_events_total counter
+session_buffering_events_total{device="Living Room",device_type="Plex for Roku",location="lan",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",stream_type="directplay",user="alice"} 1
+`, "buffering_events_total", "session_buffering_events_total")
+}
+
+func TestListenerReportsTranscodes(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+
+	session := heatSession
+	session.Decision = "transcode"
+	fake.Handle("/status/sessions", plextest.Sessions(session))
+	notify(t, fake, plextest.PlayingTranscode("7", "100", "playing", 150000, "/transcode/sessions/abc"))
+	eventually(t, server, "7", statePlaying)
+
+	transcode := plextest.Transcode{
+		Key:              "/transcode/sessions/abc",
+		Speed:            2.5,
+		Throttled:        true,
+		Progress:         40,
+		VideoDecision:    "transcode",
+		SourceVideoCodec: "hevc",
+		VideoCodec:       "h264",
+		SourceAudioCodec: "truehd",
+		AudioCodec:       "aac",
+	}
+	notify(t, fake, plextest.TranscodeUpdate(transcode))
+
+	labels := `{audio_codec="aac",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",source_audio_codec="truehd",source_video_codec="hevc",video_codec="h264",video_decision="transcode"}`
+	expected := func(progress string) string {
+		return `
+# HELP transcode_progress_percent How far through its media a transcode is
+# TYPE transcode_progress_percent gauge
+transcode_progress_percent` + labels + ` ` + progress + `
+# HELP transcode_speed Transcode speed relative to realtime
+# TYPE transcode_speed gauge
+transcode_speed` + labels + ` 2.5
+# HELP transcode_throttled Whether the transcoder is throttled because it is far enough ahead of playback
+# TYPE transcode_throttled gauge
+transcode_throttled` + labels + ` 1
+# HELP transcodes_active Transcodes serving a session that hasn't stopped, including those that have completed
+# TYPE transcodes_active gauge
+transcodes_active{server="Fake Server",server_id="fake-machine-id",server_type="plex"} 1
+`
+	}
+	names := []string{"transcode_progress_percent", "transcode_speed", "transcode_throttled", "transcodes_active"}
+	waitForMetrics := func(expected string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			err := testutil.CollectAndCompare(server, strings.NewReader(expected), names...)
+			if err == nil {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForMetrics(expected("40"))
+
+	// The transcode is still reported once it has completed, since the
+	// session keeps playing.
+	transcode.Progress = 100
+	transcode.Complete = true
+	notify(t, fake, plextest.TranscodeUpdate(transcode))
+	waitForMetrics(expected("100"))
+
+	// Stopping the session drops its transcode.
+	notify(t, fake, plextest.Playing("7", "100", "stopped", 160000))
+	eventually(t, server, "7", stateStopped)
+
+	inactive := `
+# HELP transcodes_active Transcodes serving a session that hasn't stopped, including those that have completed
+# TYPE transcodes_active gauge
+transcodes_active{server="Fake Server",server_id="fake-machine-id",server_type="plex"} 0
+`
+	compareMetrics(t, server, inactive, names...)
+
+	// Switching to direct play drops the transcode too.
+	notify(t, fake, plextest.PlayingTranscode("7", "100", "playing", 170000, "/transcode/sessions/def"))
+	transcode.Key = "/transcode/sessions/def"
+	notify(t, fake, plextest.TranscodeUpdate(transcode))
+	waitForMetrics(expected("100"))
+
+	session.Decision = "directplay"
+	fake.Handle("/status/sessions", plextest.Sessions(session))
+	notify(t, fake, plextest.Playing("7", "100", "playing", 180000))
+	waitForMetrics(inactive)
+}
+
+func TestListenerAggregatedPlays(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+
+	server := newTestServer(t, fake, WithPlayMetrics(metrics.PlayMetricsAggregated, []string{"user", "library"}))
+	runTestServer(t, fake, server)
+
+	other := heatSession
+	other.SessionKey = "8"
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession, other))
+	for _, id := range []string{"7", "8"} {
+		notify(t, fake, plextest.Playing(id, "100", "playing", 150000))
+		eventually(t, server, id, statePlaying)
+		notify(t, fake, plextest.Playing(id, "100", "paused", 150000))
+		eventually(t, server, id, statePaused)
+	}
+
+	// Both sessions roll up into one series, and per-session metrics
+	// aren't reported.
+	compareMetrics(t, server, `
+# HELP plays_aggregated_total Total sessions started, aggregated by the configured play labels
+# TYPE plays_aggregated_total counter
+plays_aggregated_total{library="Movies",server="Fake Server",server_id="fake-machine-id",server_type="plex",user="alice"} 2
+`, "plays_aggregated_total", "plays_total")
+}
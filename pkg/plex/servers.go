@@ -0,0 +1,48 @@
+package plex
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Servers collects metrics for every monitored server under a single
+// registration, so their shared descriptors don't collide.
+type Servers struct {
+	mtx     sync.Mutex
+	servers []*Server
+}
+
+func (s *Servers) Add(server *Server) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.servers = append(s.servers, server)
+}
+
+func (s *Servers) List() []*Server {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]*Server(nil), s.servers...)
+}
+
+// Lookup finds a server by its machine identifier.
+func (s *Servers) Lookup(id string) *Server {
+	for _, server := range s.List() {
+		if _, serverID := server.identity(); serverID == id {
+			return server
+		}
+	}
+	return nil
+}
+
+// Describe sends no descriptors. Servers are added as they come online, so
+// the set is registered as an unchecked collector.
+func (s *Servers) Describe(ch chan<- *prometheus.Desc) {}
+
+func (s *Servers) Collect(ch chan<- prometheus.Metric) {
+	for _, server := range s.List() {
+		server.Collect(ch)
+	}
+}
@@ -0,0 +1,81 @@
+package plex
+
+import (
+	"context"
+
+	"github.com/jrudio/go-plex-client"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/plexporter/pkg/metrics"
+)
+
+// Locations of a session's client relative to the server.
+const (
+	locationLAN = "lan"
+	locationWAN = "wan"
+)
+
+var sessionBandwidthLabels = metrics.SessionBandwidthLabelNames()
+
+type sessionBandwidth struct {
+	labels []string
+	kbps   int
+}
+
+// location returns whether a session streams to the local network or not.
+func location(m plex.Metadata) string {
+	if m.Session.Location != "" {
+		return m.Session.Location
+	}
+	if m.Player.Local {
+		return locationLAN
+	}
+	return locationWAN
+}
+
+// refreshSessions polls the bandwidth every active session is using, as
+// reported by the server.
+func (s *Server) refreshSessions(ctx context.Context) error {
+	var current plex.CurrentSessions
+	if err := s.Client.Get(ctx, "/status/sessions", &current); err != nil {
+		return err
+	}
+
+	bandwidth := []sessionBandwidth{}
+	total := map[string]int{locationLAN: 0, locationWAN: 0}
+	for _, m := range current.MediaContainer.Metadata {
+		loc := location(m)
+		total[loc] += m.Session.Bandwidth
+
+		labels, ok := s.sessions.sessionLabels(m.SessionKey, session{session: m, media: m}, sessionBandwidthLabels)
+		if !ok {
+			continue
+		}
+		bandwidth = append(bandwidth, sessionBandwidth{
+			labels: labels,
+			kbps:   m.Session.Bandwidth,
+		})
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sessionBandwidth = bandwidth
+	s.bandwidthByLocation = total
+
+	return nil
+}
+
+func (s *Server) collectSessionBandwidth(ch chan<- prometheus.Metric) {
+	for loc, kbps := range s.bandwidthByLocation {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricBandwidthKbpsDesc, prometheus.GaugeValue, float64(kbps), "plex", s.Name, s.ID, loc)
+	}
+
+	if s.playMetricsMode == metrics.PlayMetricsAggregated {
+		return
+	}
+
+	for _, b := range s.sessionBandwidth {
+		ch <- prometheus.MustNewConstMetric(metrics.MetricSessionBandwidthKbpsDesc, prometheus.GaugeValue, float64(b.kbps),
+			append([]string{"plex", s.Name, s.ID}, b.labels...)...)
+	}
+}
@@ -2,7 +2,7 @@ package plex
 
 import (
 	"context"
-	"strconv"
+	"path"
 	"sync"
 	"time"
 
@@ -25,7 +25,7 @@ const (
 	// How long metrics for sessions are kept after the last update.
 	// This is used to prune prometheus metrics and keep cardinality
 	// down.
-	sessionTimeout = time.Minute
+	defaultSessionTimeout = time.Minute
 )
 
 type session struct {
@@ -35,46 +35,169 @@ type session struct {
 	lastUpdate     time.Time
 	playStarted    time.Time
 	prevPlayedTime time.Duration
+	transcodeKey   string
+	// Rating key of the media the session last completed.
+	completedKey string
+
+	// Play series the session is counted under, and the rating key of the
+	// media it was playing when they were picked.
+	plays    []*aggregate
+	playsKey string
+
+	bufferingEvents  int64
+	bufferingTime    time.Duration
+	bufferingStarted time.Time
+	// Buffering aggregate of the current stall.
+	buffering *aggregate
+
+	// Whether the session was restored from saved state and the server
+	// hasn't reported it since.
+	restored bool
+}
+
+type transcode struct {
+	transcode  plex.TranscodeSession
+	lastUpdate time.Time
 }
 
 type sessions struct {
 	mtx                            sync.Mutex
 	sessions                       map[string]session
+	transcodes                     map[string]transcode
 	server                         *Server
 	totalEstimatedTransmittedKBits float64
+
+	// Tallies of sessions that have stopped, which outlive the sessions
+	// themselves.
+	endedSessions   int64
+	endedPlayedTime time.Duration
+
+	// Per-session play series, nil unless per-session play metrics are
+	// enabled. Sessions only differing by labels that aren't reported
+	// share a series.
+	plays *aggregates
+
+	// Completed plays by label values.
+	completed map[string]*completedPlays
+
+	// Buffering by aggregated label values.
+	buffering *aggregates
+
+	// Nil unless aggregated play metrics are enabled.
+	aggregatedPlays *aggregates
 }
 
-func NewSessions(ctx context.Context, server *Server) *sessions {
+func NewSessions(server *Server) *sessions {
 	s := &sessions{
-		sessions: map[string]session{},
-		server:   server,
+		sessions:   map[string]session{},
+		transcodes: map[string]transcode{},
+		completed:  map[string]*completedPlays{},
+		server:     server,
+
+		buffering: newAggregates(
+			metrics.MetricBufferingEventsTotalDesc,
+			metrics.MetricBufferingSecondsTotalDesc,
+			bufferingLabels,
+			false,
+		),
 	}
 
-	ticker := time.NewTicker(time.Minute)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				s.pruneOldSessions()
-			case <-ctx.Done():
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	if server.playMetricsMode != metrics.PlayMetricsAggregated {
+		s.plays = newAggregates(
+			metrics.NewPlayCountDesc(server.playLabels),
+			metrics.NewPlaySecondsTotalDesc(server.playLabels),
+			server.playLabels,
+			true,
+		)
+	}
+
+	if server.playMetricsMode != metrics.PlayMetricsSession {
+		s.aggregatedPlays = newAggregates(
+			metrics.NewPlaysAggregatedDesc(server.aggregateLabels),
+			metrics.NewPlaySecondsAggregatedDesc(server.aggregateLabels),
+			server.aggregateLabels,
+			false,
+		)
+	}
 
 	return s
 }
 
+// prune periodically drops stopped sessions until ctx is cancelled.
+func (s *sessions) prune(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.pruneOldSessions()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (s *sessions) pruneOldSessions() {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	for k, v := range s.sessions {
-		if v.state == stateStopped && time.Since(v.lastUpdate) > sessionTimeout {
+		if v.state == stateStopped && time.Since(v.lastUpdate) > s.server.sessionTimeout {
 			delete(s.sessions, k)
 		}
 	}
+
+	for _, a := range []*aggregates{s.plays, s.aggregatedPlays, s.buffering} {
+		if a != nil {
+			a.prune(s.sessions)
+		}
+	}
+
+	// Transcodes of sessions are dropped when the session stops, so only
+	// those no session claimed are pruned.
+	claimed := s.transcodeSessions()
+	for k, v := range s.transcodes {
+		if _, ok := claimed[k]; !ok && time.Since(v.lastUpdate) > s.server.sessionTimeout {
+			delete(s.transcodes, k)
+		}
+	}
+}
+
+// LinkTranscode records which transcode session serves a play session. An
+// empty key means the session plays directly, which drops the transcode it
+// had.
+func (s *sessions) LinkTranscode(sessionID, transcodeKey string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ss, ok := s.sessions[sessionID]
+	if !ok {
+		return
+	}
+	if ss.transcodeKey != "" && ss.transcodeKey != transcodeKey {
+		delete(s.transcodes, ss.transcodeKey)
+	}
+	ss.transcodeKey = transcodeKey
+	s.sessions[sessionID] = ss
+}
+
+func (s *sessions) UpdateTranscode(ts plex.TranscodeSession) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Completed transcodes are kept: their session may play for a long
+	// time after the whole file is transcoded.
+	s.transcodes[transcodeKey(ts.Key)] = transcode{
+		transcode:  ts,
+		lastUpdate: time.Now(),
+	}
+}
+
+// transcodeKey normalizes transcode session keys, which are either bare ids
+// or paths like /transcode/sessions/<id>.
+func transcodeKey(key string) string {
+	return path.Base(key)
 }
 
 func (s *sessions) Update(sessionID string, newState sessionState, newSession *plex.Metadata, media *plex.Metadata) {
@@ -82,6 +205,28 @@ func (s *sessions) Update(sessionID string, newState sessionState, newSession *p
 	defer s.mtx.Unlock()
 
 	ss := s.sessions[sessionID]
+	now := time.Now()
+
+	if ss.restored && newSession != nil {
+		// The server reuses session keys once it restarts, so a restored
+		// session only carries on if the same player plays the same media.
+		if newSession.Player.MachineIdentifier != ss.session.Player.MachineIdentifier || newSession.RatingKey != ss.session.RatingKey {
+			ss = session{}
+		}
+		ss.restored = false
+	}
+
+	if ss.state == statePlaying {
+		// Flatten the play time so far into the totals before anything
+		// changes, so it's accounted to the labels it was played under.
+		played := now.Sub(ss.playStarted)
+		ss.prevPlayedTime += played
+		s.totalEstimatedTransmittedKBits += played.Seconds() * float64(bitrate(ss.session))
+		for _, agg := range ss.plays {
+			agg.duration += played
+		}
+		ss.playStarted = now
+	}
 
 	if newSession != nil {
 		ss.session = *newSession
@@ -91,110 +236,174 @@ func (s *sessions) Update(sessionID string, newState sessionState, newSession *p
 		ss.media = *media
 	}
 
-	if ss.state == statePlaying && newState != statePlaying {
-		// If the session was playing but now is not, then flatten
-		// the play time into the total.
-		ss.prevPlayedTime += time.Since(ss.playStarted)
-		s.totalEstimatedTransmittedKBits += time.Since(ss.playStarted).Seconds() * float64(ss.session.Media[0].Bitrate)
+	if newState != stateStopped && s.watched(ss) {
+		s.complete(sessionID, &ss)
+	}
+
+	// Sessions are counted under the labels they started playing with, so
+	// changes during playback, such as of the stream's quality, don't
+	// split them across series. Playing other media is a new play.
+	newMedia := ss.plays != nil && ss.playsKey != ss.media.RatingKey
+	if newState == statePlaying && (ss.plays == nil || newMedia) {
+		firstPlay := ss.playStarted.IsZero() && ss.prevPlayedTime == 0
+		ss.plays = s.playAggregates(sessionID, ss)
+		ss.playsKey = ss.media.RatingKey
+		if firstPlay || newMedia {
+			for _, agg := range ss.plays {
+				agg.count++
+			}
+		}
 	}
 
 	if ss.state != statePlaying && newState == statePlaying {
-		// Started playing
-		ss.playStarted = time.Now()
+		ss.playStarted = now
 	}
 
+	if newState == stateStopped && ss.state != "" && ss.state != stateStopped {
+		s.endedSessions++
+		s.endedPlayedTime += ss.prevPlayedTime
+	}
+
+	if newState == stateStopped && ss.transcodeKey != "" {
+		delete(s.transcodes, ss.transcodeKey)
+		ss.transcodeKey = ""
+	}
+
+	s.updateBuffering(sessionID, &ss, newState, now)
+
 	ss.state = newState
-	ss.lastUpdate = time.Now()
+	ss.lastUpdate = now
 	s.sessions[sessionID] = ss
 }
 
+func bitrate(m plex.Metadata) int {
+	if len(m.Media) == 0 {
+		return 0
+	}
+	return m.Media[0].Bitrate
+}
+
 func (s *sessions) extrapolatedTransmittedBytes() float64 {
 
 	total := s.totalEstimatedTransmittedKBits
 
 	for _, ss := range s.sessions {
 		if ss.state == statePlaying {
-			total += time.Since(ss.playStarted).Seconds() * float64(ss.session.Media[0].Bitrate)
+			total += time.Since(ss.playStarted).Seconds() * float64(bitrate(ss.session))
 		}
 	}
 
 	return total * 128.0 // Kbits -> Bytes, 1024 / 8
 }
 
+// serverLabels returns the values of the labels every metric of the server
+// starts with.
+func (s *sessions) serverLabels() []string {
+	name, id := s.server.identity()
+	return []string{"plex", name, id}
+}
+
 func (s *sessions) Describe(ch chan<- *prometheus.Desc) {
-	ch <- metrics.MetricPlayCountDesc
-	ch <- metrics.MetricPlaySecondsTotalDesc
+	for _, a := range []*aggregates{s.plays, s.aggregatedPlays} {
+		if a != nil {
+			ch <- a.desc
+			ch <- a.secondsDesc
+		}
+	}
 
 	ch <- metrics.MetricEstimatedTransmittedBytesTotal
+	ch <- metrics.MetricSessionsEndedTotal
+	ch <- metrics.MetricSessionsEndedPlaySecondsTotal
+	ch <- metrics.MetricPlaysCompletedTotalDesc
+
+	ch <- metrics.MetricPlayPositionSecondsDesc
+	ch <- metrics.MetricPlayDurationSecondsDesc
+	ch <- metrics.MetricPlayProgressPercentDesc
+	ch <- metrics.MetricPlayRemainingSecondsDesc
+
+	ch <- metrics.MetricBufferingEventsTotalDesc
+	ch <- metrics.MetricBufferingSecondsTotalDesc
+	ch <- metrics.MetricSessionBufferingEventsTotalDesc
+	ch <- metrics.MetricSessionBufferingSecondsTotalDesc
+
+	ch <- metrics.MetricTranscodeSpeedDesc
+	ch <- metrics.MetricTranscodeThrottledDesc
+	ch <- metrics.MetricTranscodeHwRequestedDesc
+	ch <- metrics.MetricTranscodeProgressPercentDesc
+	ch <- metrics.MetricTranscodesActiveDesc
 }
 
 func (s *sessions) Collect(ch chan<- prometheus.Metric) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	for id, session := range s.sessions {
-		if session.playStarted.IsZero() {
-			continue
-		}
+	serverLabels := s.serverLabels()
 
-		title, season, episode := labels(session.media)
-		library := s.server.Library(session.media.LibrarySectionID.String())
-		if library == nil {
-			continue
+	playing := s.playingAggregates()
+	for _, a := range []*aggregates{s.plays, s.aggregatedPlays} {
+		if a != nil {
+			a.collect(ch, serverLabels, playing)
 		}
+	}
 
-		ch <- metrics.Play(
-			1.0,
-			"plex",
-			s.server.Name,
-			s.server.ID,
-			library.Name,
-			library.ID,
-			library.Type,
-			session.media.Type,
-			title,
-			season,
-			episode,
-			session.session.Media[0].Part[0].Decision,      // stream type
-			session.session.Media[0].VideoResolution,       // stream res
-			session.media.Media[0].VideoResolution,         // file res
-			strconv.Itoa(session.session.Media[0].Bitrate), // bitrate
-			session.session.Player.Device,                  // device
-			session.session.Player.Product,                 // device type
-			session.session.User.Title,
-			id,
-		)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricEstimatedTransmittedBytesTotal, prometheus.CounterValue, s.extrapolatedTransmittedBytes(), serverLabels...)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricSessionsEndedTotal, prometheus.CounterValue, float64(s.endedSessions), serverLabels...)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricSessionsEndedPlaySecondsTotal, prometheus.CounterValue, s.endedPlayedTime.Seconds(), serverLabels...)
+
+	s.collectCompleted(ch)
+	s.collectProgress(ch)
+	s.collectBuffering(ch)
+	s.collectTranscodes(ch)
+}
 
-		totalPlayTime := session.prevPlayedTime
-		if session.state == statePlaying {
-			totalPlayTime += time.Since(session.playStarted)
+// transcodeSessions maps the keys of transcodes to the sessions they serve.
+func (s *sessions) transcodeSessions() map[string]string {
+	sessionIDs := map[string]string{}
+	for id, session := range s.sessions {
+		if session.transcodeKey != "" {
+			sessionIDs[session.transcodeKey] = id
 		}
+	}
+	return sessionIDs
+}
 
-		ch <- metrics.PlayDuration(
-			float64(totalPlayTime.Seconds()),
-			"plex",
-			s.server.Name,
-			s.server.ID,
-			library.Name,
-			library.ID,
-			library.Type,
-			session.media.Type,
-			title,
-			season,
-			episode,
-			session.session.Media[0].Part[0].Decision,      // stream type
-			session.session.Media[0].VideoResolution,       // stream res
-			session.media.Media[0].VideoResolution,         // file res
-			strconv.Itoa(session.session.Media[0].Bitrate), // bitrate
-			session.session.Player.Device,                  // device
-			session.session.Player.Product,                 // device type
-			session.session.User.Title,
-			id,
+func (s *sessions) collectTranscodes(ch chan<- prometheus.Metric) {
+	sessionIDs := s.transcodeSessions()
+
+	active := 0
+	for key, t := range s.transcodes {
+		// Transcodes are reported per session, so wait until one has
+		// claimed it.
+		sessionID, ok := sessionIDs[key]
+		if !ok {
+			continue
+		}
+		active++
+
+		ts := t.transcode
+		labels := append(s.serverLabels(),
+			sessionID,
+			ts.VideoDecision,
+			ts.SourceVideoCodec,
+			ts.VideoCodec,
+			ts.SourceAudioCodec,
+			ts.AudioCodec,
 		)
+
+		ch <- prometheus.MustNewConstMetric(metrics.MetricTranscodeSpeedDesc, prometheus.GaugeValue, ts.Speed, labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricTranscodeThrottledDesc, prometheus.GaugeValue, boolToFloat(ts.Throttled), labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricTranscodeHwRequestedDesc, prometheus.GaugeValue, boolToFloat(ts.TranscodeHwRequested), labels...)
+		ch <- prometheus.MustNewConstMetric(metrics.MetricTranscodeProgressPercentDesc, prometheus.GaugeValue, ts.Progress, labels...)
 	}
 
-	ch <- prometheus.MustNewConstMetric(metrics.MetricEstimatedTransmittedBytesTotal, prometheus.CounterValue, s.extrapolatedTransmittedBytes(), "plex", s.server.Name,
-		s.server.ID)
+	ch <- prometheus.MustNewConstMetric(metrics.MetricTranscodesActiveDesc, prometheus.GaugeValue, float64(active), s.serverLabels()...)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
 }
 
 func labels(m plex.Metadata) (title, season, episodeTitle string) {
@@ -0,0 +1,324 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// ServerState holds the cumulative values of a server that have to survive
+// exporter restarts for its counters to stay monotonic.
+type ServerState struct {
+	LastBandwidthAt                int                     `json:"lastBandwidthAt"`
+	Transmitted                    []TransmittedBytesState `json:"transmitted,omitempty"`
+	BandwidthSeen                  []BandwidthKey          `json:"bandwidthSeen,omitempty"`
+	TotalEstimatedTransmittedKBits float64                 `json:"totalEstimatedTransmittedKBits"`
+	EndedSessions                  int64                   `json:"endedSessions"`
+	EndedPlaySeconds               float64                 `json:"endedPlaySeconds"`
+	Sessions                       map[string]SessionState `json:"sessions"`
+	PlaySeries                     []AggregateState        `json:"playSeries,omitempty"`
+	PlayAggregates                 []AggregateState        `json:"playAggregates,omitempty"`
+	CompletedPlays                 []CompletedPlayState    `json:"completedPlays,omitempty"`
+	Buffering                      []AggregateState        `json:"buffering,omitempty"`
+}
+
+// AggregateState keeps labels by name, so saved aggregates can be folded
+// into a different set of aggregate labels after a config change.
+type AggregateState struct {
+	Labels   map[string]string `json:"labels"`
+	Count    int64             `json:"count"`
+	Seconds  float64           `json:"seconds"`
+	Sessions []string          `json:"sessions,omitempty"`
+}
+
+type CompletedPlayState struct {
+	Labels map[string]string `json:"labels"`
+	Plays  int64             `json:"plays"`
+}
+
+type TransmittedBytesState struct {
+	Location string  `json:"location"`
+	Account  string  `json:"account"`
+	Device   string  `json:"device"`
+	Bytes    float64 `json:"bytes"`
+}
+
+// SessionState is keyed by session key, which the server reuses once it
+// restarts, so the player and media identify the session it belonged to.
+type SessionState struct {
+	Player           string  `json:"player,omitempty"`
+	RatingKey        string  `json:"ratingKey,omitempty"`
+	PlaySeconds      float64 `json:"playSeconds"`
+	CompletedKey     string  `json:"completedKey,omitempty"`
+	BufferingEvents  int64   `json:"bufferingEvents,omitempty"`
+	BufferingSeconds float64 `json:"bufferingSeconds,omitempty"`
+}
+
+// StateFile persists the state of a set of servers, keyed by machine
+// identifier.
+type StateFile struct {
+	path    string
+	servers *Servers
+
+	mtx   sync.Mutex
+	state map[string]*ServerState
+}
+
+// LoadStateFile reads previously saved state from path. A missing file is
+// treated as empty state.
+func LoadStateFile(path string, servers *Servers) (*StateFile, error) {
+	f := &StateFile{
+		path:    path,
+		servers: servers,
+		state:   map[string]*ServerState{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &f.state); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Restore applies saved state to a server. It must be called before the
+// server starts running.
+func (f *StateFile) Restore(server *Server) {
+	_, id := server.identity()
+	f.mtx.Lock()
+	state, ok := f.state[id]
+	f.mtx.Unlock()
+
+	if ok {
+		server.restoreState(state)
+	}
+}
+
+// Save writes the state of all running servers, keeping saved state of
+// servers that aren't running so it isn't lost while they're unavailable.
+func (f *StateFile) Save() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for _, server := range f.servers.List() {
+		_, id := server.identity()
+		f.state[id] = server.saveState()
+	}
+
+	data, err := json.MarshalIndent(f.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash mid-write doesn't leave
+	// a truncated state file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Run saves the state every interval until ctx is cancelled.
+func (f *StateFile) Run(ctx context.Context, interval time.Duration, log log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Save(); err != nil {
+				level.Error(log).Log("msg", "cannot save state", "path", f.path, "err", err)
+			}
+		}
+	}
+}
+
+func (s *Server) saveState() *ServerState {
+	s.mtx.Lock()
+	lastBandwidthAt := s.lastBandwidthAt
+	var bandwidthSeen []BandwidthKey
+	for key := range s.bandwidthSeen {
+		bandwidthSeen = append(bandwidthSeen, key)
+	}
+	var transmitted []TransmittedBytesState
+	for labels, bytes := range s.transmittedBytes {
+		transmitted = append(transmitted, TransmittedBytesState{
+			Location: labels.location,
+			Account:  labels.account,
+			Device:   labels.device,
+			Bytes:    bytes,
+		})
+	}
+	s.mtx.Unlock()
+
+	ss := s.sessions
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+
+	state := &ServerState{
+		LastBandwidthAt:                lastBandwidthAt,
+		Transmitted:                    transmitted,
+		BandwidthSeen:                  bandwidthSeen,
+		TotalEstimatedTransmittedKBits: ss.totalEstimatedTransmittedKBits,
+		EndedSessions:                  ss.endedSessions,
+		EndedPlaySeconds:               ss.endedPlayedTime.Seconds(),
+		Sessions:                       map[string]SessionState{},
+	}
+
+	for id, session := range ss.sessions {
+		played := session.prevPlayedTime
+		if session.state == statePlaying {
+			played += time.Since(session.playStarted)
+		}
+		state.Sessions[id] = SessionState{
+			Player:           session.session.Player.MachineIdentifier,
+			RatingKey:        session.session.RatingKey,
+			PlaySeconds:      played.Seconds(),
+			CompletedKey:     session.completedKey,
+			BufferingEvents:  session.bufferingEvents,
+			BufferingSeconds: session.stalled().Seconds(),
+		}
+	}
+
+	playing := ss.playingAggregates()
+	if ss.plays != nil {
+		state.PlaySeries = ss.plays.save(playing)
+	}
+	if ss.aggregatedPlays != nil {
+		state.PlayAggregates = ss.aggregatedPlays.save(playing)
+	}
+
+	for _, completed := range ss.completed {
+		labels := map[string]string{}
+		for i, name := range completedPlayLabels {
+			labels[name] = completed.labels[i]
+		}
+		state.CompletedPlays = append(state.CompletedPlays, CompletedPlayState{
+			Labels: labels,
+			Plays:  completed.plays,
+		})
+	}
+
+	state.Buffering = ss.buffering.save(ss.bufferingInProgress())
+
+	return state
+}
+
+func (s *Server) restoreState(state *ServerState) {
+	s.mtx.Lock()
+	if state.LastBandwidthAt > 0 {
+		s.lastBandwidthAt = state.LastBandwidthAt
+	}
+	for _, key := range state.BandwidthSeen {
+		s.bandwidthSeen[key] = true
+	}
+	for _, saved := range state.Transmitted {
+		s.addTransmittedBytes(transmitLabels{location: saved.Location, account: saved.Account, device: saved.Device}, saved.Bytes)
+	}
+	s.mtx.Unlock()
+
+	ss := s.sessions
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+
+	ss.totalEstimatedTransmittedKBits = state.TotalEstimatedTransmittedKBits
+	ss.endedSessions = state.EndedSessions
+	ss.endedPlayedTime = secondsToDuration(state.EndedPlaySeconds)
+
+	if ss.plays != nil {
+		ss.plays.restore(state.PlaySeries)
+	}
+	if ss.aggregatedPlays != nil {
+		ss.aggregatedPlays.restore(state.PlayAggregates)
+	}
+
+	for _, saved := range state.CompletedPlays {
+		ss.completedPlays(pickLabels(completedPlayLabels, saved.Labels)).plays += saved.Plays
+	}
+
+	ss.buffering.restore(state.Buffering)
+
+	// Session metadata isn't saved, so restored sessions are reported again
+	// once the server next tells us about them. Until then they count as
+	// stopped, which lets them be pruned if they never come back.
+	for id, saved := range state.Sessions {
+		restored := session{
+			state:          stateStopped,
+			lastUpdate:     time.Now(),
+			prevPlayedTime: secondsToDuration(saved.PlaySeconds),
+			completedKey:   saved.CompletedKey,
+
+			bufferingEvents: saved.BufferingEvents,
+			bufferingTime:   secondsToDuration(saved.BufferingSeconds),
+
+			restored: true,
+		}
+		restored.session.Player.MachineIdentifier = saved.Player
+		restored.session.RatingKey = saved.RatingKey
+		ss.sessions[id] = restored
+	}
+}
+
+func (a *aggregates) save(inProgress map[*aggregate]time.Duration) []AggregateState {
+	var saved []AggregateState
+	for _, agg := range a.byLabelValue {
+		labels := map[string]string{}
+		for i, name := range a.labels {
+			labels[name] = agg.labels[i]
+		}
+		var sessions []string
+		for id := range agg.sessions {
+			sessions = append(sessions, id)
+		}
+		saved = append(saved, AggregateState{
+			Labels:   labels,
+			Count:    agg.count,
+			Seconds:  (agg.duration + inProgress[agg]).Seconds(),
+			Sessions: sessions,
+		})
+	}
+	return saved
+}
+
+func (a *aggregates) restore(saved []AggregateState) {
+	for _, state := range saved {
+		agg := a.get(state.Labels)
+		agg.count += state.Count
+		agg.duration += secondsToDuration(state.Seconds)
+		for _, id := range state.Sessions {
+			agg.sessions[id] = true
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
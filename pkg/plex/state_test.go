@@ -0,0 +1,91 @@
+package plex
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+)
+
+var ronin = plextest.Media{
+	RatingKey:        "200",
+	LibrarySectionID: "1",
+	Type:             "movie",
+	Title:            "Ronin",
+	Duration:         720000,
+	Resolution:       "1080",
+	Bitrate:          8000,
+}
+
+func TestStateRestoresSessions(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+	fake.Handle("/library/metadata/200", plextest.Metadata(ronin))
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	save := func(server *Server) {
+		t.Helper()
+		servers := &Servers{}
+		servers.Add(server)
+		stateFile, err := LoadStateFile(path, servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stateFile.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := heatSession
+	other.SessionKey = "8"
+
+	server := newTestServer(t, fake)
+	runTestServer(t, fake, server)
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession, other))
+	for _, id := range []string{"7", "8"} {
+		notify(t, fake, plextest.Playing(id, "100", "playing", 150000))
+		eventually(t, server, id, statePlaying)
+		notify(t, fake, plextest.Playing(id, "100", "paused", 150000))
+		eventually(t, server, id, statePaused)
+	}
+	save(server)
+
+	// The exporter and the server restart together. Session 8 carries on,
+	// while the server hands key 7 to a new session playing other media.
+	restarted := newTestServer(t, fake)
+	stateFile, err := LoadStateFile(path, &Servers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile.Restore(restarted)
+	runTestServer(t, fake, restarted)
+
+	reused := heatSession
+	reused.Media = ronin
+	fake.Handle("/status/sessions", plextest.Sessions(reused, other))
+	notify(t, fake, plextest.Playing("7", "200", "playing", 0))
+	eventually(t, restarted, "7", statePlaying)
+	notify(t, fake, plextest.Playing("8", "100", "playing", 150000))
+	eventually(t, restarted, "8", statePlaying)
+
+	restarted.sessions.mtx.Lock()
+	reusedPlayed := restarted.sessions.sessions["7"].prevPlayedTime
+	continuedPlayed := restarted.sessions.sessions["8"].prevPlayedTime
+	restarted.sessions.mtx.Unlock()
+	if reusedPlayed != 0 {
+		t.Errorf("new session inherited %s of play time", reusedPlayed)
+	}
+	if continuedPlayed == 0 {
+		t.Error("restored session lost its play time")
+	}
+
+	// The new session is counted as a play, and the restored one isn't
+	// counted again.
+	compareMetrics(t, restarted, `
+# HELP plays_total Total play counts
+# TYPE plays_total counter
+plays_total{child_title="",device="Living Room",device_type="Plex for Roku",grandchild_title="",library="Movies",library_id="1",library_type="movie",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",stream_bitrate="8000",stream_file_resolution="1080",stream_resolution="1080",stream_type="directplay",title="Heat",user="alice"} 1
+plays_total{child_title="",device="Living Room",device_type="Plex for Roku",grandchild_title="",library="Movies",library_id="1",library_type="movie",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="7",stream_bitrate="8000",stream_file_resolution="1080",stream_resolution="1080",stream_type="directplay",title="Ronin",user="alice"} 1
+plays_total{child_title="",device="Living Room",device_type="Plex for Roku",grandchild_title="",library="Movies",library_id="1",library_type="movie",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",session="8",stream_bitrate="8000",stream_file_resolution="1080",stream_resolution="1080",stream_type="directplay",title="Heat",user="alice"} 1
+`, "plays_total")
+}
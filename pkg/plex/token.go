@@ -0,0 +1,117 @@
+package plex
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/plexporter/pkg/redact"
+)
+
+// TokenSource provides the token for a server, which may change while the
+// exporter runs.
+type TokenSource interface {
+	Token() string
+}
+
+type staticToken string
+
+func (t staticToken) Token() string {
+	return string(t)
+}
+
+// WithTokenSource takes the server's token from a source rather than the
+// token passed to NewServer.
+func WithTokenSource(tokens TokenSource) ServerOption {
+	return func(s *Server) {
+		s.Client.tokens = tokens
+	}
+}
+
+// TokenFile reads a token from a file, such as a Docker secret.
+type TokenFile struct {
+	path string
+
+	mtx   sync.Mutex
+	token string
+}
+
+func NewTokenFile(path string) (*TokenFile, error) {
+	f := &TokenFile{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *TokenFile) Token() string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.token
+}
+
+// reload reads the file again, keeping the current token if it can't be
+// read.
+func (f *TokenFile) reload() (bool, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return false, errors.New("token file is empty")
+	}
+	redact.Secret(token)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	changed := token != f.token
+	f.token = token
+	return changed, nil
+}
+
+// Watch reads the file every interval until ctx is cancelled, so a token
+// that's rotated is picked up without a restart.
+func (f *TokenFile) Watch(ctx context.Context, interval time.Duration, log log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := f.reload()
+			if err != nil {
+				level.Error(log).Log("msg", "cannot read token file", "path", f.path, "err", err)
+			} else if changed {
+				level.Info(log).Log("msg", "token file changed", "path", f.path)
+			}
+		}
+	}
+}
+
+// tokenTransport sets the current token on every request, for clients that
+// were given the token when they were created.
+type tokenTransport struct {
+	tokens TokenSource
+	next   http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Plex-Token", t.tokens.Token())
+	return next.RoundTrip(req)
+}
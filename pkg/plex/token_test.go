@@ -0,0 +1,49 @@
+package plex
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+)
+
+func TestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(plextest.Token+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenFile, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := plextest.NewServer(t)
+	server := newTestServer(t, fake, WithTokenSource(tokenFile))
+	if server.ID != plextest.MachineIdentifier {
+		t.Errorf("got server id %s, want %s", server.ID, plextest.MachineIdentifier)
+	}
+
+	if err := os.WriteFile(path, []byte("rotated-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := tokenFile.reload(); err != nil || !changed {
+		t.Fatalf("reload() = %v, %v, want a changed token", changed, err)
+	}
+	if token := server.Client.Token(); token != "rotated-token" {
+		t.Errorf("got token %s, want rotated-token", token)
+	}
+
+	// An empty file keeps the last token, so a half written secret doesn't
+	// break the server.
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenFile.reload(); err == nil {
+		t.Error("expected an error reading an empty token file")
+	}
+	if token := server.Client.Token(); token != "rotated-token" {
+		t.Errorf("got token %s, want rotated-token", token)
+	}
+}
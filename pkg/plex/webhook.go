@@ -0,0 +1,182 @@
+package plex
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/jrudio/go-plex-client"
+)
+
+// Webhooks carry a thumbnail for some events, which we read and discard.
+const maxWebhookSize = 10 << 20
+
+var webhookStates = map[string]sessionState{
+	"media.play":   statePlaying,
+	"media.resume": statePlaying,
+	"media.pause":  statePaused,
+	"media.stop":   stateStopped,
+}
+
+// Plex scrobbles media once it's been watched far enough, whether it's
+// playing or not, so a scrobble doesn't change the session's state.
+const webhookScrobble = "media.scrobble"
+
+type webhookHandler struct {
+	servers *Servers
+	secret  string
+	log     log.Logger
+}
+
+// NewWebhookHandler receives Plex webhooks and feeds playback events into
+// the sessions of the matching server. When secret is set, requests must
+// pass it in the secret query parameter.
+func NewWebhookHandler(servers *Servers, secret string, log log.Logger) http.Handler {
+	return &webhookHandler{
+		servers: servers,
+		secret:  secret,
+		log:     log,
+	}
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.secret != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("secret")), []byte(h.secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxWebhookSize)
+	if err := r.ParseMultipartForm(maxWebhookSize); err != nil {
+		http.Error(w, "cannot read form", http.StatusBadRequest)
+		return
+	}
+
+	payload := r.FormValue("payload")
+	if payload == "" {
+		http.Error(w, "missing payload", http.StatusBadRequest)
+		return
+	}
+
+	var event plex.Webhook
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		http.Error(w, "cannot parse payload", http.StatusBadRequest)
+		return
+	}
+
+	server := h.servers.Lookup(event.Server.UUID)
+	if server == nil {
+		level.Debug(h.log).Log("msg", "ignoring webhook for unknown server", "machineID", event.Server.UUID, "event", event.Event)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Every webhook is recorded, including events we don't handle.
+	server.recorder.webhook(server.URL.String(), []byte(payload))
+
+	if _, ok := webhookStates[event.Event]; !ok && event.Event != webhookScrobble {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	serverName, _ := server.identity()
+	level.Info(h.log).Log("msg", "Received webhook",
+		"event", event.Event,
+		"server", serverName,
+		"userName", event.Account.Title,
+		"player", event.Player.UUID,
+		"mediaTitle", event.Metadata.Title,
+		"mediaID", event.Metadata.RatingKey)
+
+	if err := server.onWebhook(r.Context(), event); err != nil {
+		level.Error(h.log).Log("msg", "error handling webhook", "event", event.Event, "server", serverName, "err", err)
+		http.Error(w, "cannot handle event", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) onWebhook(ctx context.Context, event plex.Webhook) error {
+	activeSessions := s.sessions
+	key := event.Player.UUID + "/" + event.Metadata.RatingKey
+
+	if event.Event == webhookScrobble {
+		s.mtx.Lock()
+		sessionKey, ok := s.webhookSessions[key]
+		s.mtx.Unlock()
+
+		if !ok {
+			session, err := s.webhookSession(ctx, event)
+			if err != nil {
+				return err
+			}
+			sessionKey = session.SessionKey
+		}
+		activeSessions.Complete(sessionKey)
+		return nil
+	}
+
+	state := webhookStates[event.Event]
+	if state == stateStopped {
+		// The session is already gone from the server, so rely on the key
+		// we saw when it started.
+		s.mtx.Lock()
+		sessionKey, ok := s.webhookSessions[key]
+		delete(s.webhookSessions, key)
+		s.mtx.Unlock()
+
+		if ok {
+			activeSessions.Update(sessionKey, stateStopped, nil, nil)
+		}
+		return nil
+	}
+
+	session, err := s.webhookSession(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	media := session
+	if !isLiveTV(*session) {
+		var metadata plex.MediaMetadata
+		if err := s.Client.Get(ctx, "/library/metadata/"+event.Metadata.RatingKey, &metadata); err != nil {
+			return fmt.Errorf("error fetching metadata for key %s: %w", event.Metadata.RatingKey, err)
+		}
+		if len(metadata.MediaContainer.Metadata) == 0 {
+			return fmt.Errorf("no metadata for key %s", event.Metadata.RatingKey)
+		}
+		media = &metadata.MediaContainer.Metadata[0]
+	}
+
+	s.mtx.Lock()
+	s.webhookSessions[key] = session.SessionKey
+	s.mtx.Unlock()
+
+	activeSessions.Update(session.SessionKey, state, session, media)
+	return nil
+}
+
+// webhookSession finds the session a webhook is about among those the
+// server is playing.
+func (s *Server) webhookSession(ctx context.Context, event plex.Webhook) (*plex.Metadata, error) {
+	var current plex.CurrentSessions
+	if err := s.Client.Get(ctx, "/status/sessions", &current); err != nil {
+		return nil, fmt.Errorf("error fetching sessions: %w", err)
+	}
+
+	for _, m := range current.MediaContainer.Metadata {
+		if m.Player.MachineIdentifier == event.Player.UUID && m.RatingKey == event.Metadata.RatingKey {
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("no session for player %s playing %s", event.Player.UUID, event.Metadata.RatingKey)
+}
@@ -0,0 +1,98 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/plexporter/pkg/plex/plextest"
+)
+
+func webhookPayload(t *testing.T, event, sessionKey, ratingKey string) []byte {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]any{
+		"event":    event,
+		"Account":  map[string]any{"title": "alice"},
+		"Server":   map[string]any{"uuid": plextest.MachineIdentifier},
+		"Player":   map[string]any{"uuid": "player-" + sessionKey},
+		"Metadata": map[string]any{"ratingKey": ratingKey, "title": "Heat"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func postWebhook(t *testing.T, handler http.Handler, secret string, payload []byte) int {
+	t.Helper()
+
+	req, err := webhookRequest(context.Background(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		req.URL.RawQuery = "secret=" + secret
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestWebhookHandler(t *testing.T) {
+	fake := plextest.NewServer(t)
+	fake.Handle("/library/metadata/100", plextest.Metadata(heat))
+	fake.Handle("/status/sessions", plextest.Sessions(heatSession))
+
+	server := newTestServer(t, fake, WithWebsocket(false))
+	servers := &Servers{}
+	servers.Add(server)
+	handler := NewWebhookHandler(servers, "webhook-secret", log.NewNopLogger())
+
+	play := webhookPayload(t, "media.play", "7", "100")
+	if code := postWebhook(t, handler, "wrong", play); code != http.StatusUnauthorized {
+		t.Errorf("got status %d with the wrong secret, want %d", code, http.StatusUnauthorized)
+	}
+	if code := postWebhook(t, handler, "webhook-secret", []byte("{")); code != http.StatusBadRequest {
+		t.Errorf("got status %d for a broken payload, want %d", code, http.StatusBadRequest)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/webhook?secret=webhook-secret", strings.NewReader("payload=x"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a request that isn't multipart, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	post := func(event string) {
+		t.Helper()
+		if code := postWebhook(t, handler, "webhook-secret", webhookPayload(t, event, "7", "100")); code != http.StatusNoContent {
+			t.Fatalf("got status %d for %s, want %d", code, event, http.StatusNoContent)
+		}
+	}
+
+	post("media.play")
+	eventually(t, server, "7", statePlaying)
+	post("media.pause")
+	eventually(t, server, "7", statePaused)
+
+	// Seeking past the end while paused scrobbles the media without
+	// resuming it.
+	post("media.scrobble")
+	eventually(t, server, "7", statePaused)
+	compareMetrics(t, server, `
+# HELP plays_completed_total Total plays that reached the completed threshold
+# TYPE plays_completed_total counter
+plays_completed_total{library="Movies",media_type="movie",server="Fake Server",server_id="fake-machine-id",server_type="plex",user="alice"} 1
+`, "plays_completed_total")
+
+	post("media.stop")
+	eventually(t, server, "7", stateStopped)
+
+	// Events we don't handle are accepted and ignored.
+	post("library.new")
+}
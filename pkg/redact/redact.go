@@ -0,0 +1,93 @@
+// Package redact keeps secrets such as Plex tokens out of logs and error
+// messages. Secrets are registered once they're known, and everything
+// logged or returned as an error is scrubbed of them.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+)
+
+const Placeholder = "<redacted>"
+
+// Shorter values are too likely to appear by chance to be replaced
+// everywhere.
+const minSecretLength = 8
+
+var (
+	mtx     sync.RWMutex
+	secrets []string
+
+	// Tokens passed as query parameters, including ones we don't know
+	// about, such as the tokens of other users in Plex responses.
+	tokenParam = regexp.MustCompile(`(?i)(x-plex-token=)[^&\s"']+`)
+)
+
+// Secret registers a value that must never be logged.
+func Secret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// String replaces the secrets in s.
+func String(s string) string {
+	mtx.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Placeholder)
+	}
+	mtx.RUnlock()
+
+	return tokenParam.ReplaceAllString(s, "${1}"+Placeholder)
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string {
+	return String(e.err.Error())
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// Error wraps err so its message is redacted. The original error can still
+// be matched with errors.Is and errors.As.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err: err}
+}
+
+// Logger redacts the values of everything logged through it.
+func Logger(next log.Logger) log.Logger {
+	return log.LoggerFunc(func(keyvals ...any) error {
+		redacted := make([]any, len(keyvals))
+		for i, v := range keyvals {
+			redacted[i] = v
+			// Values are formatted the way logfmt would, and only replaced
+			// when they contained a secret so their formatting is kept
+			// otherwise.
+			if s := fmt.Sprint(v); String(s) != s {
+				redacted[i] = String(s)
+			}
+		}
+		return next.Log(redacted...)
+	})
+}
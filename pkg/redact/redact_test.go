@@ -0,0 +1,58 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestString(t *testing.T) {
+	Secret("abcdefgh12345678")
+	Secret("short")
+
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"token abcdefgh12345678 leaked", "token <redacted> leaked"},
+		{"http://plex:32400/library?X-Plex-Token=unknown-token&a=1", "http://plex:32400/library?X-Plex-Token=<redacted>&a=1"},
+		{"a short secret", "a short secret"},
+	} {
+		if got := String(tc.in); got != tc.want {
+			t.Errorf("String(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	Secret("abcdefgh12345678")
+
+	err := Error(fmt.Errorf("open abcdefgh12345678: %w", fs.ErrNotExist))
+	if err.Error() != "open <redacted>: file does not exist" {
+		t.Errorf("got %q", err.Error())
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Error("redacted error doesn't wrap the original")
+	}
+	if Error(nil) != nil {
+		t.Error("Error(nil) isn't nil")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	Secret("abcdefgh12345678")
+
+	var buf bytes.Buffer
+	logger := Logger(log.NewLogfmtLogger(&buf))
+	logger.Log("msg", "request failed", "err", errors.New("bad token abcdefgh12345678"), "attempt", 2)
+
+	got := strings.TrimSpace(buf.String())
+	want := `msg="request failed" err="bad token <redacted>" attempt=2`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}